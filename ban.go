@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha1"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBanDuration = time.Hour
+	// Peers implicated in this many pieces that failed the hash check are
+	// banned, even if we cannot tell which of the senders was at fault
+	defaultMaxStrikes = 3
+)
+
+// blockRecord is a block of a piece that failed the hash check
+type blockRecord struct {
+	ip  string
+	sum [20]byte
+}
+
+// banList keeps track of the peers that sent us corrupt data. Every peer that
+// contributed to a piece that failed the hash check gets a strike. Once a
+// good copy of the piece arrives, the blocks of the failed copy are compared
+// with it: the senders of blocks that differ are banned right away, the
+// others are cleared of their strike
+type banList struct {
+	duration   time.Duration
+	maxStrikes int
+
+	mu      sync.Mutex
+	strikes map[string]int
+	banned  map[string]time.Time
+	failed  map[uint32][][]blockRecord
+}
+
+func newBanList(duration time.Duration, maxStrikes int) *banList {
+	if maxStrikes <= 0 {
+		maxStrikes = 1
+	}
+	return &banList{
+		duration:   duration,
+		maxStrikes: maxStrikes,
+		strikes:    map[string]int{},
+		banned:     map[string]time.Time{},
+		failed:     map[uint32][][]blockRecord{},
+	}
+}
+
+// hostOf returns the IP address of addr
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func (bl *banList) isBanned(addr string) bool {
+	ip := hostOf(addr)
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	until, has := bl.banned[ip]
+	if !has {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(bl.banned, ip)
+		return false
+	}
+	return true
+}
+
+// ban must be called with bl.mu held
+func (bl *banList) ban(ip string, reason string) {
+	if until, has := bl.banned[ip]; has && time.Now().Before(until) {
+		return
+	}
+	log.Printf("ban: banning %s for %s: %s\n", ip, bl.duration, reason)
+	bl.banned[ip] = time.Now().Add(bl.duration)
+	delete(bl.strikes, ip)
+}
+
+func blockSums(pd *pieceDownload) []blockRecord {
+	records := make([]blockRecord, pd.nblocks)
+	for b := 0; b < pd.nblocks; b++ {
+		offs, l := pd.block(b)
+		records[b] = blockRecord{hostOf(pd.senders[b]), sha1.Sum(pd.data[offs : offs+l])}
+	}
+	return records
+}
+
+// hashFailed records the blocks of a piece that failed the hash check and
+// hands out strikes to their senders. It returns the IPs that are now banned
+func (bl *banList) hashFailed(pd *pieceDownload) []string {
+	records := blockSums(pd)
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.failed[pd.index] = append(bl.failed[pd.index], records)
+
+	implicated := map[string]bool{}
+	for _, r := range records {
+		implicated[r.ip] = true
+	}
+	banned := make([]string, 0)
+	for ip := range implicated {
+		bl.strikes[ip]++
+		if bl.strikes[ip] >= bl.maxStrikes {
+			bl.ban(ip, "implicated in too many pieces that failed the hash check")
+			banned = append(banned, ip)
+		}
+	}
+	return banned
+}
+
+// hashPassed compares the failed copies of a piece, if any, with the good
+// copy. It returns the IPs that sent blocks that differ, which are now banned
+func (bl *banList) hashPassed(pd *pieceDownload) []string {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	copies, has := bl.failed[pd.index]
+	if !has {
+		return nil
+	}
+	delete(bl.failed, pd.index)
+
+	good := blockSums(pd)
+	guilty := map[string]bool{}
+	innocent := map[string]bool{}
+	for _, records := range copies {
+		for b, r := range records {
+			if r.sum != good[b].sum {
+				guilty[r.ip] = true
+			} else {
+				innocent[r.ip] = true
+			}
+		}
+	}
+	banned := make([]string, 0)
+	for ip := range guilty {
+		bl.ban(ip, "sent corrupt data")
+		banned = append(banned, ip)
+	}
+	for ip := range innocent {
+		if !guilty[ip] && bl.strikes[ip] > 0 {
+			bl.strikes[ip]--
+		}
+	}
+	return banned
+}
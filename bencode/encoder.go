@@ -0,0 +1,62 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+func encode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case int:
+		buf.WriteString("i" + strconv.FormatInt(int64(v), 10) + "e")
+	case int64:
+		buf.WriteString("i" + strconv.FormatInt(v, 10) + "e")
+	case string:
+		buf.WriteString(strconv.Itoa(len(v)) + ":" + v)
+	case []byte:
+		buf.WriteString(strconv.Itoa(len(v)) + ":")
+		buf.Write(v)
+	case []string:
+		buf.WriteByte('l')
+		for _, s := range v {
+			encode(buf, s)
+		}
+		buf.WriteByte('e')
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, e := range v {
+			if err := encode(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		// Keys must appear in sorted order (as raw strings)
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, k := range keys {
+			encode(buf, k)
+			if err := encode(buf, v[k]); err != nil {
+				return fmt.Errorf("dictionary entry %q: %s", k, err)
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("cannot encode value of type %T", v)
+	}
+	return nil
+}
+
+func Marshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := encode(buf, v); err != nil {
+		return []byte{}, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,161 @@
+// Package bitfield implements the set of pieces that a peer has, packed as in
+// the bitfield message of the peer wire protocol
+package bitfield
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Bitfield is a set of piece indices in [0, Len()). The high bit of the first
+// byte is piece 0. A Bitfield is safe for concurrent use
+type Bitfield struct {
+	mu    sync.RWMutex
+	b     []byte
+	n     int
+	count int
+}
+
+func New(n int) *Bitfield {
+	return &Bitfield{b: make([]byte, (n+7)/8), n: n}
+}
+
+// NewFull returns a Bitfield of n pieces that are all set
+func NewFull(n int) *Bitfield {
+	bf := New(n)
+	for i := 0; i < n; i++ {
+		bf.b[i/8] |= 0x80 >> uint(i%8)
+	}
+	bf.count = n
+	return bf
+}
+
+// Unpack returns the Bitfield of n pieces packed in b. It fails unless b has
+// exactly the bytes needed for n pieces and the spare bits at the end are zero
+func Unpack(b []byte, n int) (*Bitfield, error) {
+	bf := New(n)
+	if len(b) != len(bf.b) {
+		return nil, fmt.Errorf("bitfield has wrong length (got %d bytes, expected %d bytes for %d pieces)", len(b), len(bf.b), n)
+	}
+	if n%8 != 0 && b[len(b)-1]&^(0xff<<uint(8-n%8)) != 0 {
+		return nil, fmt.Errorf("bitfield has spare bits set")
+	}
+	copy(bf.b, b)
+	for _, c := range bf.b {
+		for ; c != 0; c &= c - 1 {
+			bf.count++
+		}
+	}
+	return bf, nil
+}
+
+// Pack returns the pieces packed as in the bitfield message
+func (bf *Bitfield) Pack() []byte {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	b := make([]byte, len(bf.b))
+	copy(b, bf.b)
+	return b
+}
+
+func (bf *Bitfield) Copy() *Bitfield {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	c := &Bitfield{b: make([]byte, len(bf.b)), n: bf.n, count: bf.count}
+	copy(c.b, bf.b)
+	return c
+}
+
+// Len returns the number of pieces
+func (bf *Bitfield) Len() int {
+	return bf.n
+}
+
+// Count returns the number of pieces that are set
+func (bf *Bitfield) Count() int {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	return bf.count
+}
+
+func (bf *Bitfield) Full() bool {
+	return bf.Count() == bf.n
+}
+
+// Has reports whether piece i is set; pieces out of range are never set
+func (bf *Bitfield) Has(i int) bool {
+	if i < 0 || i >= bf.n {
+		return false
+	}
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	return bf.b[i/8]&(0x80>>uint(i%8)) != 0
+}
+
+// Set sets piece i and reports whether it was not set before
+func (bf *Bitfield) Set(i int) bool {
+	if i < 0 || i >= bf.n {
+		return false
+	}
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	mask := byte(0x80 >> uint(i%8))
+	if bf.b[i/8]&mask != 0 {
+		return false
+	}
+	bf.b[i/8] |= mask
+	bf.count++
+	return true
+}
+
+// Clear clears piece i and reports whether it was set before
+func (bf *Bitfield) Clear(i int) bool {
+	if i < 0 || i >= bf.n {
+		return false
+	}
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	mask := byte(0x80 >> uint(i%8))
+	if bf.b[i/8]&mask == 0 {
+		return false
+	}
+	bf.b[i/8] &^= mask
+	bf.count--
+	return true
+}
+
+// Pieces returns the indices of the pieces that are set, in increasing order
+func (bf *Bitfield) Pieces() []int {
+	return bf.collect(true)
+}
+
+// Missing returns the indices of the pieces that are not set, in increasing
+// order
+func (bf *Bitfield) Missing() []int {
+	return bf.collect(false)
+}
+
+func (bf *Bitfield) collect(set bool) []int {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	l := make([]int, 0)
+	for i := 0; i < bf.n; i++ {
+		if (bf.b[i/8]&(0x80>>uint(i%8)) != 0) == set {
+			l = append(l, i)
+		}
+	}
+	return l
+}
+
+// HasAnyMissingFrom reports whether bf has a piece that other does not have
+func (bf *Bitfield) HasAnyMissingFrom(other *Bitfield) bool {
+	theirs := other.Pack()
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	for j := 0; j < len(bf.b) && j < len(theirs); j++ {
+		if bf.b[j]&^theirs[j] != 0 {
+			return true
+		}
+	}
+	return false
+}
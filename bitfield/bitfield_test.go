@@ -0,0 +1,148 @@
+package bitfield
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestUnpackRoundTrip(t *testing.T) {
+	for _, n := range []int{1, 7, 8, 9, 16, 100} {
+		bf := New(n)
+		for i := 0; i < n; i += 3 {
+			bf.Set(i)
+		}
+		b := bf.Pack()
+		if len(b) != (n+7)/8 {
+			t.Fatalf("%d pieces: packed into %d bytes, expected %d", n, len(b), (n+7)/8)
+		}
+		u, err := Unpack(b, n)
+		if err != nil {
+			t.Fatalf("%d pieces: unpacking: %s", n, err)
+		}
+		if u.Len() != n || u.Count() != bf.Count() {
+			t.Errorf("%d pieces: got %d pieces with %d set, expected %d with %d set", n, u.Len(), u.Count(), n, bf.Count())
+		}
+		for i := 0; i < n; i++ {
+			if u.Has(i) != bf.Has(i) {
+				t.Errorf("%d pieces: piece %d differs after round trip", n, i)
+			}
+		}
+		if !bytes.Equal(u.Pack(), b) {
+			t.Errorf("%d pieces: got %x after round trip, expected %x", n, u.Pack(), b)
+		}
+	}
+}
+
+func TestUnpackInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		n    int
+	}{
+		{"too short", []byte{0xff}, 9},
+		{"too long", []byte{0xff, 0x00}, 8},
+		{"spare bit", []byte{0x01}, 7},
+		{"all spare bits", []byte{0xff, 0x7f}, 9},
+	}
+	for _, tt := range tests {
+		if _, err := Unpack(tt.b, tt.n); err == nil {
+			t.Errorf("%s: unpacking %x as %d pieces succeeded", tt.name, tt.b, tt.n)
+		}
+	}
+}
+
+func TestSpareBits(t *testing.T) {
+	bf := NewFull(10)
+	if b := bf.Pack(); !bytes.Equal(b, []byte{0xff, 0xc0}) {
+		t.Errorf("got %x for 10 full pieces, expected ffc0", b)
+	}
+	if bf.Set(10) || bf.Has(10) || bf.Clear(10) || bf.Has(-1) {
+		t.Errorf("piece out of range changed or reported as set")
+	}
+	if bf.Count() != 10 || !bf.Full() {
+		t.Errorf("got count %d, expected 10 and full", bf.Count())
+	}
+	if _, err := Unpack([]byte{0xff, 0xc0}, 10); err != nil {
+		t.Errorf("unpacking full bitfield: %s", err)
+	}
+}
+
+func TestSetClear(t *testing.T) {
+	bf := New(20)
+	if !bf.Set(3) || bf.Set(3) {
+		t.Errorf("Set does not report whether the piece was new")
+	}
+	bf.Set(17)
+	if got := bf.Pieces(); len(got) != 2 || got[0] != 3 || got[1] != 17 {
+		t.Errorf("got pieces %v, expected [3 17]", got)
+	}
+	if len(bf.Missing()) != 18 {
+		t.Errorf("got %d missing pieces, expected 18", len(bf.Missing()))
+	}
+	other := New(20)
+	other.Set(3)
+	if !bf.HasAnyMissingFrom(other) {
+		t.Errorf("piece 17 not reported as missing from other")
+	}
+	if !bf.Clear(17) || bf.Clear(17) {
+		t.Errorf("Clear does not report whether the piece was set")
+	}
+	if bf.HasAnyMissingFrom(other) {
+		t.Errorf("pieces reported as missing from an equal bitfield")
+	}
+}
+
+// TestConcurrent is meant to be run with -race
+func TestConcurrent(t *testing.T) {
+	const n = 1000
+	const writers = 8
+	bf := New(n)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < n; i += writers {
+				if !bf.Set(i) {
+					t.Errorf("piece %d was already set", i)
+				}
+			}
+		}(w)
+	}
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			last := 0
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c := bf.Count()
+				if c < last {
+					t.Errorf("count went down from %d to %d", last, c)
+				}
+				last = c
+				bf.Has(c % n)
+				if u, err := Unpack(bf.Pack(), n); err != nil {
+					t.Errorf("unpacking concurrent snapshot: %s", err)
+				} else if u.Count() < c {
+					t.Errorf("snapshot has %d pieces, expected at least %d", u.Count(), c)
+				}
+				bf.Copy().HasAnyMissingFrom(bf)
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	if !bf.Full() || bf.Count() != n {
+		t.Errorf("got count %d, expected %d", bf.Count(), n)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/pieterkockx/bittorrent/pwp"
+)
+
+const (
+	defaultUnchokeSlots    = 4
+	defaultOptimisticSlots = 1
+	rechokeInterval        = 10 * time.Second
+	optimisticInterval     = 30 * time.Second
+	// A peer that has not sent us a block for this long while we were
+	// interested is snubbed and only gets optimistic unchokes
+	snubTimeout = 60 * time.Second
+)
+
+// chokeCandidate is what the choker needs to know about a peer
+type chokeCandidate struct {
+	peer       *peerConn
+	interested bool
+	snubbed    bool
+	// rate is the download rate from the peer, or the upload rate to the
+	// peer while seeding, in bytes per second
+	rate float64
+}
+
+type choker struct {
+	unchokeSlots    int
+	optimisticSlots int
+
+	optimistic     map[*peerConn]bool
+	lastOptimistic time.Time
+
+	// Transfer counters at the previous rate sample
+	prevDown map[*peerConn]int64
+	prevUp   map[*peerConn]int64
+	rates    map[*peerConn][2]float64
+	prevTime time.Time
+
+	kick chan struct{}
+}
+
+func newChoker(unchokeSlots, optimisticSlots int) *choker {
+	return &choker{
+		unchokeSlots:    unchokeSlots,
+		optimisticSlots: optimisticSlots,
+		optimistic:      map[*peerConn]bool{},
+		prevDown:        map[*peerConn]int64{},
+		prevUp:          map[*peerConn]int64{},
+		rates:           map[*peerConn][2]float64{},
+		kick:            make(chan struct{}, 1),
+	}
+}
+
+// notify asks for a rechoke before the next regular one, e.g. because a peer
+// became interested
+func (ch *choker) notify() {
+	select {
+	case ch.kick <- struct{}{}:
+	default:
+	}
+}
+
+// sample updates the transfer rates of peers
+func (ch *choker) sample(peers []*peerConn, now time.Time) {
+	dt := now.Sub(ch.prevTime).Seconds()
+	rates := map[*peerConn][2]float64{}
+	prevDown := map[*peerConn]int64{}
+	prevUp := map[*peerConn]int64{}
+	for _, p := range peers {
+		p.dl.Lock()
+		down := p.dl.downloaded
+		p.dl.Unlock()
+		p.up.Lock()
+		up := p.up.uploaded
+		p.up.Unlock()
+
+		if _, has := ch.prevDown[p]; has && dt > 0 {
+			rates[p] = [2]float64{float64(down-ch.prevDown[p]) / dt, float64(up-ch.prevUp[p]) / dt}
+		}
+		prevDown[p], prevUp[p] = down, up
+	}
+	ch.rates, ch.prevDown, ch.prevUp, ch.prevTime = rates, prevDown, prevUp, now
+}
+
+func (ch *choker) candidates(peers []*peerConn, seeding bool, now time.Time) []chokeCandidate {
+	cands := make([]chokeCandidate, 0, len(peers))
+	for _, p := range peers {
+		p.up.Lock()
+		interested := p.up.peerInterested
+		p.up.Unlock()
+		p.dl.Lock()
+		last := p.dl.lastBlock
+		if last.IsZero() {
+			last = p.connected
+		}
+		snubbed := p.dl.amInterested && now.Sub(last) > snubTimeout
+		p.dl.Unlock()
+
+		rate := ch.rates[p][0]
+		if seeding {
+			rate = ch.rates[p][1]
+		}
+		cands = append(cands, chokeCandidate{peer: p, interested: interested, snubbed: snubbed, rate: rate})
+	}
+	return cands
+}
+
+// decide returns the peers to unchoke: the interested peers with the best
+// rates in the regular slots, plus the optimistic unchokes. Snubbed peers
+// only qualify for optimistic unchokes, which rotate if rotate is set
+func (ch *choker) decide(cands []chokeCandidate, seeding, rotate bool) map[*peerConn]bool {
+	unchoke := map[*peerConn]bool{}
+
+	regular := make([]chokeCandidate, 0, len(cands))
+	for _, c := range cands {
+		if c.interested && (seeding || !c.snubbed) {
+			regular = append(regular, c)
+		}
+	}
+	// Shuffle first so that ties are broken randomly
+	rand.Shuffle(len(regular), func(i, j int) { regular[i], regular[j] = regular[j], regular[i] })
+	sort.SliceStable(regular, func(i, j int) bool { return regular[i].rate > regular[j].rate })
+	for i := 0; i < len(regular) && i < ch.unchokeSlots; i++ {
+		unchoke[regular[i].peer] = true
+	}
+
+	// Keep the current optimistic unchokes until it is time to rotate, as
+	// long as they are still around and interested
+	optimistic := map[*peerConn]bool{}
+	choked := make([]*peerConn, 0)
+	for _, c := range cands {
+		if !c.interested || unchoke[c.peer] {
+			continue
+		}
+		if !rotate && ch.optimistic[c.peer] && len(optimistic) < ch.optimisticSlots {
+			optimistic[c.peer] = true
+			continue
+		}
+		choked = append(choked, c.peer)
+	}
+	rand.Shuffle(len(choked), func(i, j int) { choked[i], choked[j] = choked[j], choked[i] })
+	for i := 0; i < len(choked) && len(optimistic) < ch.optimisticSlots; i++ {
+		optimistic[choked[i]] = true
+	}
+	for p := range optimistic {
+		unchoke[p] = true
+	}
+	ch.optimistic = optimistic
+
+	return unchoke
+}
+
+func (ch *choker) rechoke(peers []*peerConn, seeding bool, now time.Time) {
+	rotate := now.Sub(ch.lastOptimistic) >= optimisticInterval
+	if rotate {
+		ch.lastOptimistic = now
+	}
+	unchoke := ch.decide(ch.candidates(peers, seeding, now), seeding, rotate)
+
+	for _, p := range peers {
+		p.up.Lock()
+		changed := p.up.amChoking == unchoke[p]
+		p.up.amChoking = !unchoke[p]
+		p.up.Unlock()
+		if !changed {
+			continue
+		}
+		if unchoke[p] {
+			log.Printf("choker: unchoking %s\n", p.info.addr)
+			p.send(pwp.Message{Typ: pwp.MessageUnchoke})
+		} else {
+			log.Printf("choker: choking %s\n", p.info.addr)
+			p.send(pwp.Message{Typ: pwp.MessageChoke})
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pieterkockx/bittorrent/pwp"
+)
+
+func newTestPeer(i int) *peerConn {
+	p := &peerConn{
+		info:   &peerInfo{addr: fmt.Sprintf("10.0.0.%d:6881", i)},
+		out:    make(chan pwp.Message, 256),
+		closed: make(chan struct{}),
+	}
+	p.up.amChoking = true
+	return p
+}
+
+func TestChokerDecide(t *testing.T) {
+	type cand struct {
+		rate       float64
+		interested bool
+		snubbed    bool
+	}
+	tests := []struct {
+		name    string
+		slots   int
+		seeding bool
+		cands   []cand
+		// indices of the candidates that must be unchoked
+		unchoke []int
+	}{
+		{
+			name:    "best rates",
+			slots:   2,
+			cands:   []cand{{10, true, false}, {30, true, false}, {20, true, false}, {5, true, false}},
+			unchoke: []int{1, 2},
+		},
+		{
+			name:    "fewer candidates than slots",
+			slots:   4,
+			cands:   []cand{{10, true, false}, {30, true, false}},
+			unchoke: []int{0, 1},
+		},
+		{
+			name:    "uninterested peers",
+			slots:   2,
+			cands:   []cand{{50, false, false}, {10, true, false}, {40, false, false}, {20, true, false}},
+			unchoke: []int{1, 3},
+		},
+		{
+			name:    "snubbed peers",
+			slots:   2,
+			cands:   []cand{{50, true, true}, {10, true, false}, {40, true, false}, {20, true, false}},
+			unchoke: []int{2, 3},
+		},
+		{
+			name:    "snubbing does not matter while seeding",
+			slots:   2,
+			seeding: true,
+			cands:   []cand{{50, true, true}, {10, true, false}, {40, true, false}, {20, true, false}},
+			unchoke: []int{0, 2},
+		},
+		{
+			name:    "no slots",
+			slots:   0,
+			cands:   []cand{{10, true, false}},
+			unchoke: []int{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := newChoker(tt.slots, 0)
+			cands := make([]chokeCandidate, len(tt.cands))
+			for i, c := range tt.cands {
+				cands[i] = chokeCandidate{peer: newTestPeer(i), interested: c.interested, snubbed: c.snubbed, rate: c.rate}
+			}
+			unchoke := ch.decide(cands, tt.seeding, true)
+			if len(unchoke) != len(tt.unchoke) {
+				t.Errorf("unchoked %d peers, expected %d", len(unchoke), len(tt.unchoke))
+			}
+			for _, i := range tt.unchoke {
+				if !unchoke[cands[i].peer] {
+					t.Errorf("candidate %d with rate %.0f not unchoked", i, cands[i].rate)
+				}
+			}
+		})
+	}
+}
+
+func TestChokerOptimistic(t *testing.T) {
+	ch := newChoker(1, 1)
+	cands := []chokeCandidate{
+		{peer: newTestPeer(0), interested: true, rate: 100},
+		{peer: newTestPeer(1), interested: true, rate: 10},
+		{peer: newTestPeer(2), interested: true, rate: 10, snubbed: true},
+		{peer: newTestPeer(3), interested: false, rate: 10},
+	}
+	chosen := map[*peerConn]bool{}
+	for i := 0; i < 50; i++ {
+		unchoke := ch.decide(cands, false, true)
+		if len(unchoke) != 2 || !unchoke[cands[0].peer] {
+			t.Fatalf("unchoked %d peers, expected the fastest and one optimistic", len(unchoke))
+		}
+		if unchoke[cands[3].peer] {
+			t.Fatalf("uninterested peer unchoked optimistically")
+		}
+		for p := range ch.optimistic {
+			chosen[p] = true
+		}
+
+		// Without rotating, the optimistic unchoke stays
+		prev := ch.optimistic
+		for j := 0; j < 3; j++ {
+			ch.decide(cands, false, false)
+			for p := range prev {
+				if !ch.optimistic[p] {
+					t.Fatalf("optimistic unchoke changed without rotating")
+				}
+			}
+		}
+	}
+	// Snubbed peers still get optimistic unchokes
+	if !chosen[cands[1].peer] || !chosen[cands[2].peer] {
+		t.Errorf("rotation did not reach every choked interested peer")
+	}
+
+	// An optimistic unchoke that lost interest is replaced right away
+	for p := range ch.optimistic {
+		for i := range cands {
+			if cands[i].peer == p {
+				cands[i].interested = false
+			}
+		}
+	}
+	unchoke := ch.decide(cands, false, false)
+	if len(unchoke) != 2 {
+		t.Errorf("unchoked %d peers after the optimistic unchoke lost interest, expected 2", len(unchoke))
+	}
+}
+
+func TestChokerRotation(t *testing.T) {
+	ch := newChoker(0, 1)
+	peers := []*peerConn{newTestPeer(0), newTestPeer(1), newTestPeer(2), newTestPeer(3)}
+	for _, p := range peers {
+		p.up.peerInterested = true
+	}
+	optimistic := func() *peerConn {
+		if len(ch.optimistic) != 1 {
+			t.Fatalf("got %d optimistic unchokes, expected 1", len(ch.optimistic))
+		}
+		for p := range ch.optimistic {
+			return p
+		}
+		return nil
+	}
+
+	now := time.Now()
+	rotations := 0
+	for i := 0; i < 40; i++ {
+		ch.rechoke(peers, false, now)
+		current := optimistic()
+		if current.up.amChoking {
+			t.Fatalf("optimistic unchoke %s still choked", current.info.addr)
+		}
+		// Rechokes within the interval keep it
+		for _, d := range []time.Duration{rechokeInterval, 2 * rechokeInterval} {
+			ch.rechoke(peers, false, now.Add(d))
+			if optimistic() != current {
+				t.Fatalf("optimistic unchoke rotated after %s", d)
+			}
+		}
+		now = now.Add(optimisticInterval)
+		ch.rechoke(peers, false, now)
+		if optimistic() != current {
+			rotations++
+		}
+		now = now.Add(optimisticInterval)
+	}
+	if rotations == 0 {
+		t.Errorf("optimistic unchoke never rotated after %s", optimisticInterval)
+	}
+}
+
+func TestChokerRates(t *testing.T) {
+	// leecher sends us a lot, uploader takes a lot from us
+	leecher, uploader := newTestPeer(0), newTestPeer(1)
+	peers := []*peerConn{leecher, uploader}
+	for _, p := range peers {
+		p.up.peerInterested = true
+	}
+	now := time.Now()
+	ch := newChoker(1, 0)
+	ch.sample(peers, now)
+	leecher.dl.downloaded = 1000000
+	leecher.up.uploaded = 1000
+	uploader.dl.downloaded = 1000
+	uploader.up.uploaded = 1000000
+	ch.sample(peers, now.Add(rechokeInterval))
+
+	for _, tt := range []struct {
+		seeding  bool
+		expected *peerConn
+	}{{false, leecher}, {true, uploader}} {
+		unchoke := ch.decide(ch.candidates(peers, tt.seeding, now), tt.seeding, true)
+		if len(unchoke) != 1 || !unchoke[tt.expected] {
+			t.Errorf("seeding %t: unchoked the wrong peer", tt.seeding)
+		}
+	}
+}
+
+func TestChokerSnubbed(t *testing.T) {
+	now := time.Now()
+	p := newTestPeer(0)
+	p.connected = now.Add(-2 * snubTimeout)
+	p.dl.amInterested = true
+	ch := newChoker(1, 0)
+
+	if c := ch.candidates([]*peerConn{p}, false, now); !c[0].snubbed {
+		t.Errorf("peer that never sent a block not snubbed")
+	}
+	p.dl.lastBlock = now.Add(-snubTimeout / 2)
+	if c := ch.candidates([]*peerConn{p}, false, now); c[0].snubbed {
+		t.Errorf("peer that recently sent a block snubbed")
+	}
+	p.dl.lastBlock = time.Time{}
+	p.dl.amInterested = false
+	if c := ch.candidates([]*peerConn{p}, false, now); c[0].snubbed {
+		t.Errorf("peer that we are not interested in snubbed")
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/sha1"
+	"log"
+	"time"
+
+	"github.com/pieterkockx/bittorrent/pwp"
+)
+
+const (
+	// Upper bound on outstanding block requests to a single peer
+	maxRequestQueue = 256
+	minRequestQueue = 4
+	// Queue depth until we have measured the download rate of a peer
+	initialRequestQueue = 16
+	// The adaptive queue depth keeps this much transfer time in flight
+	requestQueueTime   = 3 * time.Second
+	rateSampleInterval = time.Second
+)
+
+// pieceDownload is a piece whose blocks are being requested, possibly from
+// several peers
+type pieceDownload struct {
+	index      uint32
+	data       []byte
+	nblocks    int
+	received   []bool
+	nreceived  int
+	requesters [][]*peerConn
+	// senders holds the address of the peer that sent each block
+	senders []string
+}
+
+func numBlocks(length uint32) int {
+	return int((length + blockLength - 1) / blockLength)
+}
+
+func newPieceDownload(index, length uint32) *pieceDownload {
+	n := numBlocks(length)
+	return &pieceDownload{
+		index:      index,
+		data:       make([]byte, length),
+		nblocks:    n,
+		received:   make([]bool, n),
+		requesters: make([][]*peerConn, n),
+		senders:    make([]string, n),
+	}
+}
+
+func (pd *pieceDownload) block(i int) (offset, length uint32) {
+	offset = uint32(i) * blockLength
+	length = blockLength
+	if offset+length > uint32(len(pd.data)) {
+		length = uint32(len(pd.data)) - offset
+	}
+	return
+}
+
+func (pd *pieceDownload) requestedBy(b int, p *peerConn) bool {
+	for _, r := range pd.requesters[b] {
+		if r == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (pd *pieceDownload) removeRequester(b int, p *peerConn) bool {
+	for i, r := range pd.requesters[b] {
+		if r == p {
+			pd.requesters[b] = append(pd.requesters[b][:i], pd.requesters[b][i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type blockKey struct {
+	index  uint32
+	offset uint32
+}
+
+// requestQueueDepth returns the number of requests to keep outstanding: the
+// configured number, or else enough to cover requestQueueTime at the measured
+// rate, but never more than the peer accepts
+func requestQueueDepth(configured int, rate float64, reqq int) int {
+	d := configured
+	if d <= 0 {
+		d = initialRequestQueue
+		if rate > 0 {
+			d = int(rate * requestQueueTime.Seconds() / float64(blockLength))
+		}
+		if d < minRequestQueue {
+			d = minRequestQueue
+		}
+	}
+	if d > reqq {
+		d = reqq
+	}
+	if d > maxRequestQueue {
+		d = maxRequestQueue
+	}
+	return d
+}
+
+// download keeps requests for blocks outstanding at peer, spanning several
+// pieces if needed, until the connection is closed or all pieces are set
+func (s *swarm) download(peer *peerConn) {
+	addr := peer.info.addr
+
+	// giveBack withdraws all outstanding requests; replies that still
+	// arrive are discarded by peer.handle
+	giveBack := func() {
+		peer.dl.Lock()
+		for k := range peer.dl.requests {
+			s.picker.cancel(peer, k)
+		}
+		peer.dl.requests = map[blockKey]bool{}
+		peer.dl.Unlock()
+		// Drop replies that made it into the channel in the meantime
+		for len(peer.blocks) > 0 {
+			pwp.Release(<-peer.blocks)
+		}
+	}
+	defer giveBack()
+
+	rate := float64(0)
+	sampled := time.Now()
+	prev := int64(0)
+	// Time of the last block received, or of the first request after we
+	// had nothing outstanding
+	progress := time.Now()
+
+	for {
+		if now := time.Now(); now.Sub(sampled) >= rateSampleInterval {
+			peer.dl.Lock()
+			n := peer.dl.downloaded
+			peer.dl.Unlock()
+			r := float64(n-prev) / now.Sub(sampled).Seconds()
+			if prev == 0 && rate == 0 {
+				rate = r
+			} else {
+				rate = 0.7*rate + 0.3*r
+			}
+			prev, sampled = n, now
+		}
+
+		// Get the channel before requesting so that no wake up is missed
+		changed := s.picker.wait()
+
+		peer.dl.Lock()
+		depth := requestQueueDepth(s.requestQueue, rate, peer.dl.reqq)
+		// Forget requests for blocks that another peer delivered first (in
+		// endgame mode); that peer sent the cancel
+		for k := range peer.dl.requests {
+			if !s.picker.requested(peer, k) {
+				delete(peer.dl.requests, k)
+			}
+		}
+		// While choked, no new requests are sent. A peer with the fast
+		// extension keeps the ones it has, but if it neither serves nor
+		// rejects them they time out as usual
+		choked := peer.dl.peerChoking
+		if len(peer.dl.requests) == 0 {
+			progress = time.Now()
+		}
+		requests := make([]pwp.Message, 0)
+		for !choked && len(peer.dl.requests) < depth {
+			k, l, ok := s.picker.request(peer)
+			if !ok {
+				break
+			}
+			peer.dl.requests[k] = true
+			requests = append(requests, pwp.Message{Typ: pwp.MessageRequest, PieceIndex: k.index, BlockOffset: k.offset, BlockLength: l})
+		}
+		outstanding := len(peer.dl.requests)
+		peer.dl.Unlock()
+
+		for _, r := range requests {
+			if !peer.send(r) {
+				return
+			}
+		}
+
+		// Replies may still be waiting in peer.blocks when nothing is
+		// outstanding anymore, so there is no timeout but blocks are read
+		var timeout <-chan time.Time
+		if outstanding > 0 {
+			timeout = time.After(time.Until(progress.Add(pieceTimeout)))
+		}
+
+		select {
+		case msg := <-peer.blocks:
+			k := blockKey{msg.PieceIndex, msg.BlockOffset}
+			progress = time.Now()
+			if msg.BlockOffset%blockLength != 0 || uint32(len(msg.Data)) != expectedBlockLength(s.m, k) {
+				log.Printf("download: %s sent block of piece %d (offset %d) with length %d bytes, expected %d bytes: closing\n", addr, msg.PieceIndex, msg.BlockOffset, len(msg.Data), expectedBlockLength(s.m, k))
+				s.picker.cancel(peer, k)
+				pwp.Release(msg)
+				peer.close()
+				return
+			}
+			s.c.transferred.downloaded.Add(int64(len(msg.Data)))
+			others, pd := s.picker.receive(peer, k, msg.Data)
+			pwp.Release(msg)
+			for _, o := range others {
+				o.send(pwp.Message{Typ: pwp.MessageCancel, PieceIndex: k.index, BlockOffset: k.offset, BlockLength: expectedBlockLength(s.m, k)})
+			}
+			if pd != nil {
+				s.finishPiece(pd)
+			}
+		case <-changed:
+		case <-peer.changed:
+		case <-peer.closed:
+			return
+		case <-s.done:
+			return
+		case <-timeout:
+			log.Printf("download: no block from %s for %s: putting requests back in queue\n", addr, pieceTimeout)
+			giveBack()
+		}
+	}
+}
+
+func expectedBlockLength(m metainfo, k blockKey) uint32 {
+	l := blockLength
+	if size := m.pieceSize(k.index); k.offset+l > size {
+		l = size - k.offset
+	}
+	return l
+}
+
+// finishPiece verifies and stores a piece of which all blocks were received
+func (s *swarm) finishPiece(pd *pieceDownload) {
+	if sha1.Sum(pd.data) != s.m.pieceHashes[pd.index] {
+		log.Printf("download: piece %d: hash differs: putting it back in queue\n", pd.index)
+		s.picker.finish(pd.index, false)
+		for _, ip := range s.bans.hashFailed(pd) {
+			s.disconnect(ip)
+		}
+		return
+	}
+	for _, ip := range s.bans.hashPassed(pd) {
+		s.disconnect(ip)
+	}
+	err := storePiece(piece{pd.index, pd.data}, s.m.pieceLength, s.m.firstFile)
+	if err != nil {
+		log.Printf("download: storing piece %d: %s: putting it back in queue\n", pd.index, err)
+		s.picker.finish(pd.index, false)
+		return
+	}
+	log.Printf("download: got piece %d\n", pd.index)
+	s.picker.finish(pd.index, true)
+	s.announce(pd.index)
+}
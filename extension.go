@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pieterkockx/bittorrent/bencode"
+	"github.com/pieterkockx/bittorrent/pwp"
+)
+
+// Number of outstanding requests we assume a peer supports if it does not
+// tell us in its extended handshake
+const defaultPeerReqq = 250
+
+// Longest extended message we read
+const maxExtendedLength = uint32(0x10000)
+
+type extendedHandshake struct {
+	reqq int
+}
+
+func makeExtendedHandshake(c client) pwp.Message {
+	d := map[string]interface{}{
+		"m":    map[string]interface{}{},
+		"v":    "bittorrent/" + version,
+		"reqq": int64(maxRequestQueue),
+	}
+	if port, err := strconv.Atoi(c.port); err == nil {
+		d["p"] = int64(port)
+	}
+	b, err := bencode.Marshal(d)
+	if err != nil {
+		panic(fmt.Sprintf("marshaling extended handshake: %s", err))
+	}
+	return pwp.Message{Typ: pwp.MessageExtended, ExtendedID: pwp.ExtendedHandshakeID, Data: b}
+}
+
+func parseExtendedHandshake(b []byte) (extendedHandshake, error) {
+	d, err := bencode.UnmarshalDict(b)
+	if err != nil {
+		return extendedHandshake{}, fmt.Errorf("unmarshaling extended handshake: %s", err)
+	}
+	h := extendedHandshake{reqq: defaultPeerReqq}
+	if i, b := d["reqq"].(int64); b && i > 0 {
+		h.reqq = int(i)
+	}
+	return h, nil
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+
+	"github.com/pieterkockx/bittorrent/bitfield"
 )
 
 type fileList struct {
@@ -28,8 +30,8 @@ func (firstFile *fileList) String() string {
 	return s
 }
 
-func (firstFile *fileList) build(length uint32, total int64, hashes [][20]byte) ([]bool, error) {
-	piecesSet := make([]bool, len(hashes))
+func (firstFile *fileList) build(length uint32, total int64, hashes [][20]byte) (*bitfield.Bitfield, error) {
+	pieces := bitfield.New(len(hashes))
 	i := 0
 
 	buf := make([]byte, length)
@@ -39,7 +41,7 @@ func (firstFile *fileList) build(length uint32, total int64, hashes [][20]byte)
 		if f.isdir {
 			err := os.MkdirAll(f.path, 0700)
 			if err != nil {
-				return []bool{}, fmt.Errorf("creating directory (perm=0700) %s: %s", f.path, err)
+				return nil, fmt.Errorf("creating directory (perm=0700) %s: %s", f.path, err)
 			}
 			continue
 		}
@@ -47,18 +49,18 @@ func (firstFile *fileList) build(length uint32, total int64, hashes [][20]byte)
 		var err error
 		f.file, err = os.OpenFile(f.path, os.O_RDWR|os.O_CREATE, 0600)
 		if err != nil {
-			return []bool{}, fmt.Errorf("opening (mode=O_RDWR|O_CREATE,perm=0600) %s: %s", f.path, err)
+			return nil, fmt.Errorf("opening (mode=O_RDWR|O_CREATE,perm=0600) %s: %s", f.path, err)
 		}
 		err = f.file.Truncate(f.size)
 		if err != nil {
-			return []bool{}, fmt.Errorf("truncating %s to %d bytes: %s", f.path, f.size, err)
+			return nil, fmt.Errorf("truncating %s to %d bytes: %s", f.path, f.size, err)
 		}
 
 		for {
 			n, err := f.file.Read(p)
 			if n < len(p) {
 				if err != nil && err != io.EOF {
-					return []bool{}, fmt.Errorf("reading %s: %s", f.path, err)
+					return nil, fmt.Errorf("reading %s: %s", f.path, err)
 				}
 				p = p[n:]
 				// If err == nil, assume at EOF
@@ -66,7 +68,7 @@ func (firstFile *fileList) build(length uint32, total int64, hashes [][20]byte)
 			}
 			p = buf
 			if sha1.Sum(p) == hashes[i] {
-				piecesSet[i] = true
+				pieces.Set(i)
 			}
 			i++
 		}
@@ -75,8 +77,8 @@ func (firstFile *fileList) build(length uint32, total int64, hashes [][20]byte)
 
 	p = buf[:len(buf)-len(p)]
 	if len(p) > 0 && sha1.Sum(p) == hashes[i] {
-		piecesSet[i] = true
+		pieces.Set(i)
 	}
 
-	return piecesSet, nil
+	return pieces, nil
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Local Service Discovery (BEP 14): peers announce the torrents they have to
+// a multicast group, so that peers on the same network find each other
+// without a tracker
+const (
+	lsdIPv4Group = "239.192.152.143:6771"
+	lsdIPv6Group = "[ff15::efc0:988f]:6771"
+	lsdInterval  = 5 * time.Minute
+	// Announces from the same peer are passed on at most this often
+	lsdMinInterval = time.Minute
+	// At most this many peers are remembered within lsdMinInterval; new
+	// ones are ignored beyond that
+	maxLSDPeers = 1000
+)
+
+type lsdAnnounce struct {
+	port       string
+	infoHashes []string
+	cookie     string
+}
+
+func makeLSDAnnounce(group, port string, infoHash [20]byte, cookie string) []byte {
+	return []byte(fmt.Sprintf("BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %s\r\nInfohash: %x\r\ncookie: %s\r\n\r\n\r\n", group, port, infoHash, cookie))
+}
+
+func parseLSDAnnounce(b []byte) (lsdAnnounce, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return lsdAnnounce{}, err
+	}
+	if req.Method != "BT-SEARCH" {
+		return lsdAnnounce{}, fmt.Errorf("unknown method %q", req.Method)
+	}
+	port := req.Header.Get("Port")
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 0xffff {
+		return lsdAnnounce{}, fmt.Errorf("invalid port %q", port)
+	}
+	return lsdAnnounce{port: port, infoHashes: req.Header.Values("Infohash"), cookie: req.Header.Get("Cookie")}, nil
+}
+
+func (a lsdAnnounce) has(infoHash [20]byte) bool {
+	h := hex.EncodeToString(infoHash[:])
+	for _, s := range a.infoHashes {
+		if strings.EqualFold(s, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// discoverLocalPeers announces the torrent to the IPv4 and IPv6 groups on
+// iface (or the interface the system picks if nil) and sends the addresses
+// of peers that announce it to addrs
+func discoverLocalPeers(c client, iface *net.Interface, addrs chan string) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("local discovery: making cookie: %s\n", err)
+		return
+	}
+	// The cookie tells our own announces apart
+	cookie := hex.EncodeToString(b)
+
+	for _, group := range []string{lsdIPv4Group, lsdIPv6Group} {
+		gaddr, err := net.ResolveUDPAddr("udp", group)
+		if err != nil {
+			log.Printf("local discovery: resolving %s: %s\n", group, err)
+			continue
+		}
+		l, err := net.ListenMulticastUDP("udp", iface, gaddr)
+		if err != nil {
+			log.Printf("local discovery: joining %s: %s\n", group, err)
+			continue
+		}
+		// The listening socket does not loop multicast back to the
+		// host, so announces go out through another one
+		conn, err := net.DialUDP("udp", lsdSource(iface, gaddr), gaddr)
+		if err != nil {
+			log.Printf("local discovery: announcing to %s: %s\n", group, err)
+			l.Close()
+			continue
+		}
+		log.Printf("local discovery: joined %s\n", group)
+		go listenLSD(c, l, cookie, addrs)
+		go announceLSD(conn, makeLSDAnnounce(group, c.port, c.infoHash, cookie))
+	}
+}
+
+// lsdSource returns an address of iface in the family of group, from which
+// multicast leaves through iface, or nil to leave it to the system
+func lsdSource(iface *net.Interface, group *net.UDPAddr) *net.UDPAddr {
+	if iface == nil {
+		return nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || (n.IP.To4() != nil) != (group.IP.To4() != nil) {
+			continue
+		}
+		addr := &net.UDPAddr{IP: n.IP}
+		if n.IP.IsLinkLocalUnicast() {
+			addr.Zone = iface.Name
+		}
+		return addr
+	}
+	return nil
+}
+
+func announceLSD(conn *net.UDPConn, msg []byte) {
+	for {
+		if _, err := conn.Write(msg); err != nil {
+			log.Printf("local discovery: announcing to %s: %s\n", conn.RemoteAddr(), err)
+		}
+		time.Sleep(lsdInterval)
+	}
+}
+
+func listenLSD(c client, l *net.UDPConn, cookie string, addrs chan string) {
+	seen := map[string]time.Time{}
+	swept := time.Now()
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := l.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("local discovery: reading from %s: %s\n", l.LocalAddr(), err)
+			return
+		}
+		a, err := parseLSDAnnounce(buf[:n])
+		if err != nil || a.cookie == cookie || !a.has(c.infoHash) {
+			continue
+		}
+		host := src.IP.String()
+		if src.Zone != "" {
+			host += "%" + src.Zone
+		}
+		addr := net.JoinHostPort(host, a.port)
+		// Peers are forgotten once their next announce is passed on anyway
+		now := time.Now()
+		if now.Sub(swept) >= lsdMinInterval {
+			for peer, t := range seen {
+				if now.Sub(t) >= lsdMinInterval {
+					delete(seen, peer)
+				}
+			}
+			swept = now
+		}
+		t, has := seen[addr]
+		if has && now.Sub(t) < lsdMinInterval {
+			continue
+		}
+		if !has && len(seen) >= maxLSDPeers {
+			continue
+		}
+		seen[addr] = now
+		log.Printf("local discovery: found peer %s\n", addr)
+		addrs <- addr
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/rand"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLSDAnnounceRoundTrip(t *testing.T) {
+	infoHash := [20]byte{0xab, 0xcd, 19: 0xef}
+	b := makeLSDAnnounce(lsdIPv4Group, "6881", infoHash, "c00k1e")
+	if !strings.HasPrefix(string(b), "BT-SEARCH * HTTP/1.1\r\n") || !strings.HasSuffix(string(b), "\r\n\r\n\r\n") {
+		t.Errorf("got announce %q, expected a BT-SEARCH request ending in two empty lines", b)
+	}
+	a, err := parseLSDAnnounce(b)
+	if err != nil {
+		t.Fatalf("parsing announce: %s", err)
+	}
+	if a.port != "6881" || a.cookie != "c00k1e" {
+		t.Errorf("got port %q and cookie %q, expected 6881 and c00k1e", a.port, a.cookie)
+	}
+	if !a.has(infoHash) || a.has([20]byte{}) {
+		t.Errorf("got info hashes %q, expected only %x", a.infoHashes, infoHash)
+	}
+}
+
+func TestParseLSDAnnounce(t *testing.T) {
+	infoHash := [20]byte{0xab, 19: 0xef}
+	tests := []struct {
+		name string
+		msg  string
+		err  bool
+		has  bool
+	}{
+		{"upper case hash", "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 1\r\nInfohash: AB000000000000000000000000000000000000EF\r\n\r\n", false, true},
+		{"several hashes", "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 65535\r\nInfohash: 0000000000000000000000000000000000000000\r\nInfohash: ab000000000000000000000000000000000000ef\r\n\r\n", false, true},
+		{"no hash", "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\n\r\n", false, false},
+		{"other method", "GET * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\n\r\n", true, false},
+		{"no port", "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\n\r\n", true, false},
+		{"port out of range", "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 65536\r\n\r\n", true, false},
+		{"garbage", "\x00\x01\x02", true, false},
+	}
+	for _, tt := range tests {
+		a, err := parseLSDAnnounce([]byte(tt.msg))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: got error %v, expected error %t", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && a.has(infoHash) != tt.has {
+			t.Errorf("%s: got has %t, expected %t", tt.name, !tt.has, tt.has)
+		}
+	}
+}
+
+func TestListenLSD(t *testing.T) {
+	// Announces are sent straight to the listening socket, which need not
+	// be a multicast one
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	addrs := make(chan string)
+	c := client{infoHash: [20]byte{1, 2, 3}}
+	done := make(chan struct{})
+	go func() {
+		listenLSD(c, l, "ours", addrs)
+		close(done)
+	}()
+
+	src, err := net.DialUDP("udp", nil, l.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dialing: %s", err)
+	}
+	defer src.Close()
+	send := func(b []byte) {
+		if _, err := src.Write(b); err != nil {
+			t.Fatalf("sending announce: %s", err)
+		}
+	}
+	expect := func(port string) {
+		t.Helper()
+		select {
+		case addr := <-addrs:
+			if addr != "127.0.0.1:"+port {
+				t.Errorf("got peer %s, expected 127.0.0.1:%s", addr, port)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no peer found for port %s", port)
+		}
+	}
+
+	// Our own announce, another torrent and garbage are all ignored, so
+	// the first peer found is the one announced last
+	send(makeLSDAnnounce(lsdIPv4Group, "1000", c.infoHash, "ours"))
+	send(makeLSDAnnounce(lsdIPv4Group, "1001", [20]byte{9}, "theirs"))
+	send([]byte("garbage"))
+	send(makeLSDAnnounce(lsdIPv4Group, "1002", c.infoHash, "theirs"))
+	expect("1002")
+
+	// A repeated announce is passed on once per lsdMinInterval
+	send(makeLSDAnnounce(lsdIPv4Group, "1002", c.infoHash, "theirs"))
+	send(makeLSDAnnounce(lsdIPv4Group, "1003", c.infoHash, "theirs"))
+	expect("1003")
+
+	l.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("listenLSD did not return after the socket was closed")
+	}
+}
+
+func TestListenLSDLimit(t *testing.T) {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	defer l.Close()
+	addrs := make(chan string)
+	c := client{infoHash: [20]byte{1, 2, 3}}
+	go listenLSD(c, l, "ours", addrs)
+	src, err := net.DialUDP("udp", nil, l.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dialing: %s", err)
+	}
+	defer src.Close()
+
+	// Each peer is taken before the next one is announced, so that no
+	// announce gets dropped
+	for port := 1; port <= maxLSDPeers+1; port++ {
+		if _, err := src.Write(makeLSDAnnounce(lsdIPv4Group, strconv.Itoa(port), c.infoHash, "theirs")); err != nil {
+			t.Fatalf("sending announce: %s", err)
+		}
+		timeout := 5 * time.Second
+		if port > maxLSDPeers {
+			timeout = 200 * time.Millisecond
+		}
+		select {
+		case addr := <-addrs:
+			if port > maxLSDPeers {
+				t.Fatalf("got peer %s beyond the %d remembered ones", addr, maxLSDPeers)
+			}
+		case <-time.After(timeout):
+			if port <= maxLSDPeers {
+				t.Fatalf("no peer found for port %d", port)
+			}
+		}
+	}
+}
+
+// multicastWorks tells whether multicast to group loops back to this host
+func multicastWorks(group string) bool {
+	gaddr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return false
+	}
+	l, err := net.ListenMulticastUDP("udp", nil, gaddr)
+	if err != nil {
+		return false
+	}
+	defer l.Close()
+	conn, err := net.DialUDP("udp", nil, gaddr)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("probe")); err != nil {
+		return false
+	}
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1500)
+	for {
+		n, err := l.Read(buf)
+		if err != nil {
+			return false
+		}
+		if string(buf[:n]) == "probe" {
+			return true
+		}
+	}
+}
+
+func TestDiscoverLocalPeers(t *testing.T) {
+	if !multicastWorks(lsdIPv4Group) {
+		t.Skip("multicast is not available")
+	}
+	// The info hash keeps out announces of anything else on the network
+	var infoHash [20]byte
+	rand.Read(infoHash[:])
+	a := client{port: "50101", infoHash: infoHash}
+	b := client{port: "50102", infoHash: infoHash}
+	aAddrs, bAddrs := make(chan string, 8), make(chan string, 8)
+
+	// b announces after a has joined, and a ignores its own announce
+	go discoverLocalPeers(a, nil, aAddrs)
+	time.Sleep(100 * time.Millisecond)
+	go discoverLocalPeers(b, nil, bAddrs)
+	select {
+	case addr := <-aAddrs:
+		if _, port, _ := net.SplitHostPort(addr); port != b.port {
+			t.Errorf("got peer %s, expected one on port %s", addr, b.port)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no local peer found")
+	}
+}
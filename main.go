@@ -1,20 +1,44 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/pieterkockx/bittorrent/bencode"
-	"github.com/pieterkockx/bittorrent/pwp"
+	"github.com/pieterkockx/bittorrent/bitfield"
+	"github.com/pieterkockx/bittorrent/mse"
+	"github.com/pieterkockx/bittorrent/tracker"
+	"github.com/pieterkockx/bittorrent/utp"
 )
 
 type client struct {
-	port      string
-	peerID    [20]byte
-	infoHash  [20]byte
-	piecesSet []bool
+	port     string
+	ipv6     string
+	tracker  *trackerClient
+	peerID   [20]byte
+	infoHash [20]byte
+	// pieces and transferred are shared by everyone holding a copy of the
+	// client
+	pieces      *bitfield.Bitfield
+	transferred *transferStats
+}
+
+// transferStats counts the bytes of piece data sent to and received from
+// all peers, which are reported to trackers
+type transferStats struct {
+	uploaded, downloaded atomic.Int64
 }
 
 type metainfo struct {
@@ -22,6 +46,8 @@ type metainfo struct {
 	pieceLength uint32
 	totalSize   int64
 	firstFile   *fileList
+	// private torrents only get peers from their trackers
+	private bool
 }
 
 func (c client) String() string {
@@ -30,6 +56,9 @@ func (c client) String() string {
 		s += fmt.Sprintf("%02x", c.infoHash[i])
 	}
 	s += fmt.Sprintf("\npeer id: %q", c.peerID[:])
+	if c.ipv6 != "" {
+		s += fmt.Sprintf("\nipv6: %s", c.ipv6)
+	}
 	return s
 }
 
@@ -73,6 +102,9 @@ func parseMetainfo(v map[string]interface{}) (metainfo, error) {
 	}
 	m.pieceLength = uint32(i)
 
+	i, b = d["private"].(int64)
+	m.private = b && i == 1
+
 	m.firstFile = &fileList{next: lastFile}
 
 	i, single := d["length"].(int64)
@@ -193,83 +225,183 @@ func parseTrackerURLs(v map[string]interface{}) ([]string, error) {
 	return urls, nil
 }
 
-func managePieces(clientPiecesSet []bool, out chan uint32) {
-	log.Printf("piece manager: started\n")
+type torrent struct {
+	infoHash [20]byte
+	meta     metainfo
+	urls     []string
+}
 
-	// Speculative pieces set
-	piecesSet := make([]bool, len(clientPiecesSet))
-	copy(piecesSet, clientPiecesSet)
+func readTorrent(r io.Reader) (torrent, error) {
+	b1, err := ioutil.ReadAll(r)
+	if err != nil {
+		return torrent{}, fmt.Errorf("reading torrent file: %s", err)
+	}
 
-	for {
-		i := uint32(0)
-		for ; int64(i) < int64(len(piecesSet)); i++ {
-			if !piecesSet[i] {
-				break
-			}
-		}
-		if int64(i) == int64(len(piecesSet)) {
-			n := 0
-			for j := 0; j < len(clientPiecesSet); j++ {
-				if clientPiecesSet[j] {
-					n++
-				}
-			}
-			if n == len(clientPiecesSet) {
-				close(out)
-				return
-			}
+	b2, err := bencode.UnmarshalDict(b1)
+	if err != nil {
+		return torrent{}, fmt.Errorf("unmarshaling metainfo dictionary: %s", err)
+	}
 
-			// Copy actual pieces set into speculative pieces set
-			copy(piecesSet, clientPiecesSet)
-			log.Printf("piece manager: copied actual pieces set into speculative pieces set (got %d [of %d] pieces)\n", n, len(clientPiecesSet))
+	infoHash, err := bencode.HashInfo(b1)
+	if err != nil {
+		return torrent{}, fmt.Errorf("hashing info dictionary: %s", err)
+	}
 
-			continue
-		}
-		piecesSet[i] = true
+	m, err := parseMetainfo(b2)
+	if err != nil {
+		return torrent{}, fmt.Errorf("parsing info dictionary: %s", err)
+	}
 
-		out <- i
+	urls, err := parseTrackerURLs(b2)
+	if err != nil {
+		return torrent{}, fmt.Errorf("parsing tracker URLs: %s", err)
 	}
+
+	return torrent{infoHash, m, urls}, nil
 }
 
+const usage = `usage: bittorrent [command] [flags] < file.torrent
+
+commands:
+  download  download the torrent (default)
+  scrape    print seeders, leechers and completed counts of every tracker
+  tracker   run an HTTP tracker (see bittorrent tracker -h)
+  version   print the client version
+`
+
 func main() {
-	// PART 1 - OFFLINE
+	cmd := "download"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "download":
+		download(args)
+	case "scrape":
+		scrape(args)
+	case "tracker":
+		runTracker(args)
+	case "version":
+		fmt.Printf("bittorrent %s (peer ID prefix %s)\n", version, defaultPeerIDPrefix())
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
 
-	b1, err := ioutil.ReadAll(os.Stdin)
+func scrape(args []string) {
+	flags := flag.NewFlagSet("scrape", flag.ExitOnError)
+	trackerCfg := trackerClientConfig{}
+	trackerCfg.registerFlags(flags)
+	flags.Parse(args)
+
+	tc, err := newTrackerClient(trackerCfg)
 	if err != nil {
-		log.Fatalf("reading torrent file (from stdin): %s\n", err)
+		log.Fatalf("creating tracker client: %s\n", err)
 	}
 
-	b2, err := bencode.UnmarshalDict(b1)
+	t, err := readTorrent(os.Stdin)
 	if err != nil {
-		log.Fatalf("unmarshaling metainfo dictionary: %s\n", err)
+		log.Fatalf("reading torrent (from stdin): %s\n", err)
 	}
+	for _, s := range tc.scrapeAll(t.infoHash, t.urls, time.Time{}) {
+		if s.err != nil {
+			fmt.Printf("%s: error: %s\n", s.host, s.err)
+			continue
+		}
+		fmt.Printf("%s: %s\n", s.host, s.result)
+	}
+}
 
-	infoHash, err := bencode.HashInfo(b1)
+func runTracker(args []string) {
+	flags := flag.NewFlagSet("tracker", flag.ExitOnError)
+	addr := flags.String("addr", ":6969", "address to listen on")
+	interval := flags.Duration("interval", tracker.DefaultInterval, "announce interval sent to clients")
+	minInterval := flags.Duration("min-interval", tracker.DefaultMinInterval, "minimum announce interval sent to clients")
+	expiry := flags.Duration("expiry", 0, "time after which peers that stopped announcing are dropped (default 2*interval)")
+	allow := flags.String("allow", "", "file with hex encoded info hashes to track, one per line (default all)")
+	trustIP := flags.Bool("trust-ip", false, "use the ip parameter sent by clients as their address")
+	flags.Parse(args)
+
+	cfg := tracker.Config{Interval: *interval, MinInterval: *minInterval, PeerExpiry: *expiry, TrustIP: *trustIP}
+	if *allow != "" {
+		b, err := ioutil.ReadFile(*allow)
+		if err != nil {
+			log.Fatalf("reading allowlist: %s\n", err)
+		}
+		cfg.Allowlist = make([][20]byte, 0)
+		for _, l := range strings.Fields(string(b)) {
+			h, err := tracker.ParseInfoHash(l)
+			if err != nil {
+				log.Fatalf("parsing allowlist: %s\n", err)
+			}
+			cfg.Allowlist = append(cfg.Allowlist, h)
+		}
+	}
+
+	log.Printf("tracker: listening on %s\n", *addr)
+	log.Fatal(http.ListenAndServe(*addr, tracker.New(cfg)))
+}
+
+func download(args []string) {
+	flags := flag.NewFlagSet("download", flag.ExitOnError)
+	trackerCfg := trackerClientConfig{}
+	trackerCfg.registerFlags(flags)
+	requestQueue := flags.Int("request-queue", 0, "outstanding block requests per peer (default adapted to the download rate)")
+	unchokeSlots := flags.Int("unchoke-slots", defaultUnchokeSlots, "number of peers unchoked for their transfer rate")
+	optimisticSlots := flags.Int("optimistic-slots", defaultOptimisticSlots, "number of peers unchoked optimistically")
+	seed := flags.Bool("seed", false, "keep running and uploading after the download completes")
+	banDuration := flags.Duration("ban-duration", defaultBanDuration, "how long peers that sent corrupt data are banned")
+	banStrikes := flags.Int("ban-strikes", defaultMaxStrikes, "number of failed pieces a peer may be implicated in before it is banned")
+	limits := rateLimits{}
+	limits.registerFlags(flags)
+	rateFile := flags.String("rate-file", "", "file with rate limits (as flags without the dash, one per line), reread on SIGHUP")
+	transport := flags.String("transport", "prefer-tcp", "transport of peer connections: tcp, utp, prefer-tcp or prefer-utp")
+	lsd := flags.Bool("lsd", true, "discover peers on the local network (never for private torrents)")
+	lsdInterface := flags.String("lsd-interface", "", "network interface for local peer discovery (default chosen by the system)")
+	encryption := flags.String("encryption", "prefer", "encryption of peer connections: plaintext, prefer or require")
+	suppressHave := flags.Bool("suppress-have", false, "do not send have messages to peers that have the piece")
+	port := flags.Int("port", 50000, "port to listen on for peer connections")
+	maxPeers := flags.Int("max-peers", defaultMaxPeers, "maximum number of simultaneous peer connections")
+	peerIDPrefix := flags.String("peer-id-prefix", defaultPeerIDPrefix(), "prefix of the peer ID, followed by random characters")
+	flags.Parse(args)
+
+	encryptionPolicy, err := mse.ParsePolicy(*encryption)
 	if err != nil {
-		log.Fatalf("hashing info dictionary: %s\n", err)
+		log.Fatalf("%s\n", err)
+	}
+	transports, err := parseTransportPolicy(*transport)
+	if err != nil {
+		log.Fatalf("%s\n", err)
 	}
 
-	m, err := parseMetainfo(b2)
+	// PART 1 - OFFLINE
+
+	tc, err := newTrackerClient(trackerCfg)
 	if err != nil {
-		log.Fatalf("parsing info dictionary: %s\n", err)
+		log.Fatalf("creating tracker client: %s\n", err)
 	}
 
-	urls, err := parseTrackerURLs(b2)
+	t, err := readTorrent(os.Stdin)
 	if err != nil {
-		log.Fatalf("parsing tracker URLs: %s\n", err)
+		log.Fatalf("reading torrent (from stdin): %s\n", err)
 	}
+	m, infoHash, urls := t.meta, t.infoHash, t.urls
 
-	var peerID [20]byte
-	copy(peerID[:], []byte("-PK-0100-0123456890a"))
+	peerID, err := makePeerID(*peerIDPrefix)
+	if err != nil {
+		log.Fatalf("making peer ID: %s\n", err)
+	}
 
-	piecesSet, err := m.firstFile.build(m.pieceLength, m.totalSize, m.pieceHashes)
+	pieces, err := m.firstFile.build(m.pieceLength, m.totalSize, m.pieceHashes)
 	if err != nil {
 		log.Fatalf("building file tree: %s\n", err)
 	}
 
 	// metainfo is not modified from here on
 
-	c := client{peerID: peerID, infoHash: infoHash, port: "50000", piecesSet: piecesSet}
+	c := client{peerID: peerID, infoHash: infoHash, port: strconv.Itoa(*port), ipv6: localIPv6(), pieces: pieces, transferred: &transferStats{}, tracker: tc}
 
 	fmt.Printf("%s\n", m)
 	fmt.Printf("%s\n", c)
@@ -278,57 +410,76 @@ func main() {
 
 	// PART 2 - ONLINE
 
-	peers := make(chan *peerConn)
-	go managePeers(c, m, urls, peers)
-
-	pieces := make(chan uint32)
-	go managePieces(c.piecesSet, pieces)
-
-	// Flow control: limit maximum outstanding pieces
-	wait := make(chan int, 5)
-
-	log.Printf("main: waiting for connection\n")
-	peer := <-peers
-	log.Printf("main: got connection to %s\n", peer.info.addr)
-
-	for piece := range pieces {
-		log.Printf("main: getting piece %d\n", piece)
-
-		select {
-		case wait <- 1:
-		// Only available if peer was closed
-		case peer = <-peers:
-			log.Printf("main: got new connection to %s\n", peer.info.addr)
+	s := newSwarm(c, m, *maxPeers, *requestQueue, newChoker(*unchokeSlots, *optimisticSlots), newBanList(*banDuration, *banStrikes))
+	s.haveSuppression = *suppressHave
+	s.encryption = encryptionPolicy
+	if *rateFile != "" {
+		limits, err = readRateLimits(*rateFile, limits)
+		if err != nil {
+			log.Fatalf("reading rate limits: %s\n", err)
 		}
+		go reloadRateLimits(s, *rateFile, limits)
+	}
+	s.setLimits(limits)
 
-		go func(out chan pwp.Message, p uint32) {
-			log.Printf("main (forked): going to get piece %d\n", p)
-
-			l := m.pieceLength
-			// Last piece might have a smaller length
-			if int64(p) == int64(len(c.piecesSet))-1 {
-				r := uint32(m.totalSize) % m.pieceLength
-				if r != 0 {
-					l = r
-				}
-			}
+	s.transport = transports
+	if transports != utpOnly {
+		l, err := net.Listen("tcp", net.JoinHostPort("", c.port))
+		if err != nil {
+			log.Fatalf("listening for peer connections: %s\n", err)
+		}
+		go s.listen(l)
+	}
+	if transports != tcpOnly {
+		s.utp, err = utp.Listen(net.JoinHostPort("", c.port))
+		if err != nil {
+			log.Fatalf("listening for uTP peer connections: %s\n", err)
+		}
+		go s.listen(s.utp)
+	}
 
-			err := getPiece(out, p, l, m)
-			<-wait
+	discover := *lsd && !m.private
+	if discover {
+		var iface *net.Interface
+		if *lsdInterface != "" {
+			iface, err = net.InterfaceByName(*lsdInterface)
 			if err != nil {
-				// Avoid sending on closed pieces channel.
-				// Note that the pieces channel can only be closed if the whole piecesSet is true
-				if !c.piecesSet[p] {
-					log.Printf("main (forked): geting piece %d: %s: putting it back in queue\n", p, err)
-					pieces <- p
-				} else {
-					log.Printf("main (forked): geting piece %d: %s, but already got it\n", p, err)
-				}
-				return
+				log.Fatalf("finding interface for local peer discovery: %s\n", err)
 			}
-			log.Printf("main (forked): got piece %d\n", p)
-			c.piecesSet[p] = true
-		}(peer.out, piece)
+		}
+		go discoverLocalPeers(c, iface, s.addrs)
+	}
+	// Local peers may still turn up when no tracker answers
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		managePeers(c, m, urls, s.addrs, s.done, stop, discover)
+		close(stopped)
+	}()
+	go s.run()
+	go s.choke()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	interrupted := false
+	select {
+	case <-s.done:
+		log.Printf("main: finished succesfully\n")
+		if *seed {
+			log.Printf("main: seeding\n")
+			<-sig
+		}
+	case <-sig:
+		interrupted = true
+	}
+
+	// Give the trackers a chance to hear that we completed and stop
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(stopTimeout):
+		log.Printf("main: timed out announcing that we stop\n")
+	}
+	if interrupted {
+		log.Fatalln("main: interrupted before the download completed")
 	}
-	log.Printf("main: finished succesfully\n")
 }
@@ -0,0 +1,368 @@
+// Package mse implements Message Stream Encryption, the obfuscation of peer
+// wire connections with a Diffie-Hellman key exchange and RC4
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+)
+
+// Policy decides which connections are encrypted
+type Policy int
+
+const (
+	// PlaintextOnly never uses the MSE handshake
+	PlaintextOnly Policy = iota
+	// PreferEncrypted tries the MSE handshake on outbound connections and
+	// prefers RC4, but accepts plaintext connections
+	PreferEncrypted
+	// RequireEncrypted only accepts connections encrypted with RC4
+	RequireEncrypted
+)
+
+var policyToString = map[Policy]string{
+	PlaintextOnly:    "plaintext",
+	PreferEncrypted:  "prefer",
+	RequireEncrypted: "require",
+}
+
+func (p Policy) String() string {
+	if s, has := policyToString[p]; has {
+		return s
+	}
+	return fmt.Sprintf("unknown (%d)", int(p))
+}
+
+func ParsePolicy(s string) (Policy, error) {
+	for p, name := range policyToString {
+		if name == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown encryption policy %q", s)
+}
+
+const (
+	cryptoPlaintext = uint32(0x01)
+	cryptoRC4       = uint32(0x02)
+
+	maxPadLength = 512
+	keyLength    = 96
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+
+	protocolHeader = []byte("\x13BitTorrent protocol")
+)
+
+func (p Policy) provide() uint32 {
+	if p == RequireEncrypted {
+		return cryptoRC4
+	}
+	return cryptoRC4 | cryptoPlaintext
+}
+
+// selectCrypto picks one of the methods in provide, or returns 0 if there is
+// none that the policy allows
+func (p Policy) selectCrypto(provide uint32) uint32 {
+	if provide&cryptoRC4 != 0 {
+		return cryptoRC4
+	}
+	if provide&cryptoPlaintext != 0 && p != RequireEncrypted {
+		return cryptoPlaintext
+	}
+	return 0
+}
+
+// conn is a connection after the MSE handshake. The initial payload of the
+// initiator, if any, is read before the rest of the stream
+type conn struct {
+	net.Conn
+	r       *bufio.Reader
+	initial []byte
+	dec     *rc4.Cipher
+	enc     *rc4.Cipher
+	wbuf    []byte
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	if len(c.initial) > 0 {
+		n := copy(p, c.initial)
+		c.initial = c.initial[n:]
+		return n, nil
+	}
+	n, err := c.r.Read(p)
+	if c.dec != nil {
+		c.dec.XORKeyStream(p[:n], p[:n])
+	}
+	return n, err
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(p)
+	}
+	// p must not be modified, so encrypt a copy
+	if cap(c.wbuf) < len(p) {
+		c.wbuf = make([]byte, len(p))
+	}
+	b := c.wbuf[:len(p)]
+	c.enc.XORKeyStream(b, p)
+	return c.Conn.Write(b)
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// newCipher returns RC4 with key, after discarding the first 1024 bytes of
+// the key stream
+func newCipher(key []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(key)
+	var discard [1024]byte
+	c.XORKeyStream(discard[:], discard[:])
+	return c
+}
+
+// keyPair returns a private key and the padded public key
+func keyPair() (*big.Int, []byte, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(b)
+	y := new(big.Int).Exp(generator, x, prime)
+	pub := make([]byte, keyLength)
+	y.FillBytes(pub)
+	return x, pub, nil
+}
+
+func sharedSecret(x *big.Int, pub []byte) []byte {
+	y := new(big.Int).SetBytes(pub)
+	s := make([]byte, keyLength)
+	new(big.Int).Exp(y, x, prime).FillBytes(s)
+	return s
+}
+
+func randomPad() ([]byte, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPadLength+1))
+	if _, err := rand.Read(pad); err != nil {
+		return nil, err
+	}
+	return pad, nil
+}
+
+// synchronize reads from r until the last bytes read equal pattern, giving up
+// after max bytes
+func synchronize(r *bufio.Reader, pattern []byte, max int) error {
+	window := make([]byte, 0, max)
+	for len(window) < max {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no synchronization pattern in %d bytes", max)
+}
+
+// Client performs the MSE handshake as the initiator of conn, for the
+// torrent with infoHash. Deadlines are up to the caller
+func Client(c net.Conn, infoHash [20]byte, policy Policy) (net.Conn, error) {
+	return client(c, infoHash, policy, nil)
+}
+
+// client is Client sending initial as the initial payload
+func client(c net.Conn, infoHash [20]byte, policy Policy, initial []byte) (net.Conn, error) {
+	x, pubA, err := keyPair()
+	if err != nil {
+		return nil, fmt.Errorf("generating key: %s", err)
+	}
+	padA, err := randomPad()
+	if err != nil {
+		return nil, fmt.Errorf("generating padding: %s", err)
+	}
+	if _, err := c.Write(append(pubA, padA...)); err != nil {
+		return nil, fmt.Errorf("writing public key: %s", err)
+	}
+
+	r := bufio.NewReader(c)
+	pubB := make([]byte, keyLength)
+	if _, err := io.ReadFull(r, pubB); err != nil {
+		return nil, fmt.Errorf("reading public key: %s", err)
+	}
+	if bytes.HasPrefix(pubB, protocolHeader) {
+		return nil, fmt.Errorf("peer does not support encryption")
+	}
+	s := sharedSecret(x, pubB)
+	enc := newCipher(hash([]byte("keyA"), s, infoHash[:]))
+	dec := newCipher(hash([]byte("keyB"), s, infoHash[:]))
+
+	// Padding is left empty
+	b := hash([]byte("req1"), s)
+	req2 := hash([]byte("req2"), infoHash[:])
+	req3 := hash([]byte("req3"), s)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	b = append(b, req2...)
+	tail := make([]byte, 8+4+2+2+len(initial))
+	binary.BigEndian.PutUint32(tail[8:12], policy.provide())
+	binary.BigEndian.PutUint16(tail[14:16], uint16(len(initial)))
+	copy(tail[16:], initial)
+	enc.XORKeyStream(tail, tail)
+	b = append(b, tail...)
+	if _, err := c.Write(b); err != nil {
+		return nil, fmt.Errorf("writing crypto provide: %s", err)
+	}
+
+	// The encrypted verification constant marks the end of the padding of
+	// the peer
+	vc := make([]byte, 8)
+	dec.XORKeyStream(vc, vc)
+	if err := synchronize(r, vc, maxPadLength+len(vc)); err != nil {
+		return nil, fmt.Errorf("reading verification constant: %s", err)
+	}
+	reply := make([]byte, 4+2)
+	if _, err := io.ReadFull(r, reply); err != nil {
+		return nil, fmt.Errorf("reading crypto select: %s", err)
+	}
+	dec.XORKeyStream(reply, reply)
+	selected := binary.BigEndian.Uint32(reply[:4])
+	if selected&policy.provide() == 0 || (selected != cryptoRC4 && selected != cryptoPlaintext) {
+		return nil, fmt.Errorf("peer selected unknown encryption method %#x", selected)
+	}
+	padD := make([]byte, binary.BigEndian.Uint16(reply[4:6]))
+	if len(padD) > maxPadLength {
+		return nil, fmt.Errorf("padding of %d bytes too long", len(padD))
+	}
+	if _, err := io.ReadFull(r, padD); err != nil {
+		return nil, fmt.Errorf("reading padding: %s", err)
+	}
+	dec.XORKeyStream(padD, padD)
+
+	if selected == cryptoPlaintext {
+		return &conn{Conn: c, r: r}, nil
+	}
+	return &conn{Conn: c, r: r, dec: dec, enc: enc}, nil
+}
+
+// Server performs the MSE handshake as the receiver of conn, for the torrent
+// with infoHash. Peers that start with the plaintext BitTorrent handshake
+// are let through unless the policy requires encryption
+func Server(c net.Conn, infoHash [20]byte, policy Policy) (net.Conn, error) {
+	r := bufio.NewReader(c)
+	start, err := r.Peek(len(protocolHeader))
+	if err != nil {
+		return nil, fmt.Errorf("reading handshake: %s", err)
+	}
+	if bytes.Equal(start, protocolHeader) {
+		if policy == RequireEncrypted {
+			return nil, fmt.Errorf("peer does not use encryption")
+		}
+		return &conn{Conn: c, r: r}, nil
+	}
+	if policy == PlaintextOnly {
+		return nil, fmt.Errorf("peer uses encryption")
+	}
+
+	pubA := make([]byte, keyLength)
+	if _, err := io.ReadFull(r, pubA); err != nil {
+		return nil, fmt.Errorf("reading public key: %s", err)
+	}
+	y, pubB, err := keyPair()
+	if err != nil {
+		return nil, fmt.Errorf("generating key: %s", err)
+	}
+	padB, err := randomPad()
+	if err != nil {
+		return nil, fmt.Errorf("generating padding: %s", err)
+	}
+	if _, err := c.Write(append(pubB, padB...)); err != nil {
+		return nil, fmt.Errorf("writing public key: %s", err)
+	}
+	s := sharedSecret(y, pubA)
+
+	req1 := hash([]byte("req1"), s)
+	if err := synchronize(r, req1, maxPadLength+len(req1)); err != nil {
+		return nil, fmt.Errorf("reading synchronization hash: %s", err)
+	}
+	req23 := make([]byte, 20)
+	if _, err := io.ReadFull(r, req23); err != nil {
+		return nil, fmt.Errorf("reading torrent hash: %s", err)
+	}
+	req2 := hash([]byte("req2"), infoHash[:])
+	req3 := hash([]byte("req3"), s)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	if !bytes.Equal(req2, req23) {
+		return nil, fmt.Errorf("peer asked for another torrent")
+	}
+	dec := newCipher(hash([]byte("keyA"), s, infoHash[:]))
+	enc := newCipher(hash([]byte("keyB"), s, infoHash[:]))
+
+	b := make([]byte, 8+4+2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("reading crypto provide: %s", err)
+	}
+	dec.XORKeyStream(b, b)
+	if !bytes.Equal(b[:8], make([]byte, 8)) {
+		return nil, fmt.Errorf("wrong verification constant")
+	}
+	selected := policy.selectCrypto(binary.BigEndian.Uint32(b[8:12]))
+	if selected == 0 {
+		return nil, fmt.Errorf("no acceptable encryption method in %#x", binary.BigEndian.Uint32(b[8:12]))
+	}
+	padC := make([]byte, binary.BigEndian.Uint16(b[12:14]))
+	if len(padC) > maxPadLength {
+		return nil, fmt.Errorf("padding of %d bytes too long", len(padC))
+	}
+	if _, err := io.ReadFull(r, padC); err != nil {
+		return nil, fmt.Errorf("reading padding: %s", err)
+	}
+	dec.XORKeyStream(padC, padC)
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, fmt.Errorf("reading initial payload length: %s", err)
+	}
+	dec.XORKeyStream(l[:], l[:])
+	initial := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, initial); err != nil {
+		return nil, fmt.Errorf("reading initial payload: %s", err)
+	}
+	dec.XORKeyStream(initial, initial)
+
+	reply := make([]byte, 8+4+2)
+	binary.BigEndian.PutUint32(reply[8:12], selected)
+	enc.XORKeyStream(reply, reply)
+	if _, err := c.Write(reply); err != nil {
+		return nil, fmt.Errorf("writing crypto select: %s", err)
+	}
+
+	if selected == cryptoPlaintext {
+		return &conn{Conn: c, r: r, initial: initial}, nil
+	}
+	return &conn{Conn: c, r: r, initial: initial, dec: dec, enc: enc}, nil
+}
@@ -0,0 +1,170 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var testHash = [20]byte{0xaa, 19: 0x55}
+
+type result struct {
+	c   net.Conn
+	err error
+}
+
+// handshake runs client and server over a pipe. A side that fails closes its
+// end, so that the other side fails too instead of blocking
+func handshake(t *testing.T, clientPolicy, serverPolicy Policy, clientHash, serverHash [20]byte, initial []byte) (result, result) {
+	t.Helper()
+	a, b := net.Pipe()
+	cc, sc := make(chan result, 1), make(chan result, 1)
+	go func() {
+		c, err := client(a, clientHash, clientPolicy, initial)
+		if err != nil {
+			a.Close()
+		}
+		cc <- result{c, err}
+	}()
+	go func() {
+		c, err := Server(b, serverHash, serverPolicy)
+		if err != nil {
+			b.Close()
+		}
+		sc <- result{c, err}
+	}()
+	var rs [2]result
+	for i, ch := range []chan result{cc, sc} {
+		select {
+		case rs[i] = <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handshake blocked")
+		}
+	}
+	return rs[0], rs[1]
+}
+
+// roundTrip checks that what one side writes is what the other side reads
+func roundTrip(t *testing.T, w, r net.Conn, msg []byte) {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := w.Write(msg)
+		errc <- err
+	}()
+	b := make([]byte, len(msg))
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatalf("reading: %s", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("writing: %s", err)
+	}
+	if !bytes.Equal(b, msg) {
+		t.Errorf("read %q, expected %q", b, msg)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		client, server Policy
+		ok             bool
+	}{
+		{PreferEncrypted, PlaintextOnly, false},
+		{PreferEncrypted, PreferEncrypted, true},
+		{PreferEncrypted, RequireEncrypted, true},
+		{RequireEncrypted, PlaintextOnly, false},
+		{RequireEncrypted, PreferEncrypted, true},
+		{RequireEncrypted, RequireEncrypted, true},
+	}
+	for _, tt := range tests {
+		cr, sr := handshake(t, tt.client, tt.server, testHash, testHash, nil)
+		if !tt.ok {
+			if cr.err == nil || sr.err == nil {
+				t.Errorf("client %s, server %s: got errors %v and %v, expected both to fail", tt.client, tt.server, cr.err, sr.err)
+			}
+			continue
+		}
+		if cr.err != nil || sr.err != nil {
+			t.Errorf("client %s, server %s: got errors %v and %v", tt.client, tt.server, cr.err, sr.err)
+			continue
+		}
+		if cr.c.(*conn).enc == nil || sr.c.(*conn).enc == nil {
+			t.Errorf("client %s, server %s: connection not encrypted", tt.client, tt.server)
+		}
+		roundTrip(t, cr.c, sr.c, []byte("\x13BitTorrent protocol from the client"))
+		roundTrip(t, sr.c, cr.c, []byte("\x13BitTorrent protocol from the server"))
+		cr.c.Close()
+	}
+}
+
+func TestInitialPayload(t *testing.T) {
+	cr, sr := handshake(t, PreferEncrypted, PreferEncrypted, testHash, testHash, []byte("initial"))
+	if cr.err != nil || sr.err != nil {
+		t.Fatalf("got errors %v and %v", cr.err, sr.err)
+	}
+	defer cr.c.Close()
+	// The initial payload is read before what follows it
+	go cr.c.Write([]byte(" and the rest"))
+	b := make([]byte, len("initial and the rest"))
+	if _, err := io.ReadFull(sr.c, b); err != nil {
+		t.Fatalf("reading: %s", err)
+	}
+	if string(b) != "initial and the rest" {
+		t.Errorf("read %q, expected %q", b, "initial and the rest")
+	}
+	roundTrip(t, sr.c, cr.c, []byte("reply"))
+}
+
+func TestWrongInfoHash(t *testing.T) {
+	cr, sr := handshake(t, PreferEncrypted, PreferEncrypted, testHash, [20]byte{0xbb}, nil)
+	if cr.err == nil || sr.err == nil {
+		t.Errorf("got errors %v and %v, expected both to fail", cr.err, sr.err)
+	}
+}
+
+func TestPlaintextFallback(t *testing.T) {
+	handshake := append([]byte(nil), protocolHeader...)
+	handshake = append(handshake, make([]byte, 48)...)
+	for _, policy := range []Policy{PlaintextOnly, PreferEncrypted, RequireEncrypted} {
+		a, b := net.Pipe()
+		go a.Write(handshake)
+		c, err := Server(b, testHash, policy)
+		if policy == RequireEncrypted {
+			if err == nil {
+				t.Errorf("%s: plaintext handshake accepted", policy)
+			}
+			a.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: plaintext handshake rejected: %s", policy, err)
+			a.Close()
+			continue
+		}
+		// Nothing of the handshake is lost
+		got := make([]byte, len(handshake))
+		if _, err := io.ReadFull(c, got); err != nil {
+			t.Fatalf("%s: reading handshake: %s", policy, err)
+		}
+		if !bytes.Equal(got, handshake) {
+			t.Errorf("%s: read %q, expected %q", policy, got, handshake)
+		}
+		a.Close()
+	}
+
+	// A peer answering our public key with a plaintext handshake does not
+	// support encryption, so the caller can reconnect in plaintext
+	a, b := net.Pipe()
+	go func() {
+		b.Read(make([]byte, keyLength+maxPadLength))
+		// The handshake followed by a bitfield fills a public key
+		b.Write(append(handshake, make([]byte, keyLength)...))
+		b.Close()
+	}()
+	if _, err := Client(a, testHash, PreferEncrypted); err == nil {
+		t.Errorf("handshake with a plaintext peer succeeded")
+	}
+	a.Close()
+}
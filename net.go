@@ -3,86 +3,133 @@ package main
 import (
 	"log"
 	"net"
-	"sync"
 	"time"
 
 	"github.com/pieterkockx/bittorrent/pwp"
 )
 
-type messageInbox struct {
-	sync.Mutex
-	dir map[string]chan pwp.Message
-}
-
-var inbox = messageInbox{dir: map[string]chan pwp.Message{}}
-
-func expect(in chan pwp.Message, msg pwp.Message) {
-	inbox.Lock()
-	defer inbox.Unlock()
-	inbox.dir[msg.Id()] = in
-}
-
-func forward(msg pwp.Message) {
-	inbox.Lock()
-	defer inbox.Unlock()
-	ch, has := inbox.dir[msg.Id()]
-	if has {
-		delete(inbox.dir, msg.Id())
-		ch <- msg
-	} else {
-		log.Printf("forward: no receiver for %s message: discarding\n", msg.Typ)
-	}
-}
-
-func unforward(msg pwp.Message) {
-	inbox.Lock()
-	defer inbox.Unlock()
-	ch, has := inbox.dir[msg.Id()]
-	if has {
-		delete(inbox.dir, msg.Id())
-		close(ch)
-	} else {
-		log.Printf("warning: unforward was asked to delete non-existent entry\n")
-	}
-}
+const (
+	// A connection on which nothing arrives for this long is closed
+	connIdleTimeout   = 3 * time.Minute
+	keepAliveInterval = 90 * time.Second
+)
 
-func receive(conn net.Conn, pleaseClose chan bool) {
+// receive reads messages from the peer and updates the connection state
+// accordingly. Messages concerning uploads go to p.requests and blocks go to
+// p.blocks; nothing is shared with other connections except the picker
+func receive(p *peerConn, pleaseClose chan bool) {
+	conn := p.conn
 	for {
-		conn.SetReadDeadline(time.Now().Add(connReadDeadline))
-		msg, err := pwp.ReadMessage(conn)
+		conn.SetReadDeadline(time.Now().Add(connIdleTimeout))
+		msg, err := conn.Decode()
+		if err == nil && msg.Typ == pwp.MessagePiece {
+			// Not reading on slows the peer down
+			p.downLimit.wait(len(msg.Data))
+		}
+		if err == nil {
+			err = p.handle(msg)
+		}
 		if err != nil {
 			log.Printf("receive: %s: please close %s\n", err, conn.RemoteAddr())
 			pleaseClose <- true
 			log.Printf("receive: thanks in advance for closing %s\n", conn.RemoteAddr())
 			return
 		}
-		forward(msg)
 	}
 }
 
-func send(conn net.Conn, out chan pwp.Message, pleaseClose, closed chan bool) {
+// send writes messages from out to conn until asked to close, after which it
+// closes the closed channel so that everyone waiting on the connection is
+// notified. Keep-alives are sent when there is nothing else to send. Messages
+// that are ready together are written together; blocks are held back as long
+// as limit requires
+func send(conn *pwp.Conn, out chan pwp.Message, limit limiters, pleaseClose chan bool, closed chan struct{}) {
 	for {
 		msg := pwp.Message{}
 
 		select {
 		case msg = <-out:
+		case <-time.After(keepAliveInterval):
+			msg = pwp.Message{Typ: pwp.MessageKeepAlive}
 		case <-pleaseClose:
 			log.Printf("send: was asked to close %s\n", conn.RemoteAddr())
 			conn.Close()
-			closed <- true
+			close(closed)
 			log.Printf("send: closed %s\n", conn.RemoteAddr())
 			return
 		}
 
-		conn.SetWriteDeadline(time.Now().Add(connWriteDeadline))
-		_, err := conn.Write(msg.Marshal())
+		var err error
+		for {
+			if msg.Typ == pwp.MessagePiece {
+				if d := limit.delay(blockSize(msg)); d > 0 {
+					// Do not hold back what is buffered while waiting
+					conn.SetWriteDeadline(time.Now().Add(connWriteDeadline))
+					if err = conn.Flush(); err != nil {
+						break
+					}
+					time.Sleep(d)
+				}
+			}
+			conn.SetWriteDeadline(time.Now().Add(connWriteDeadline))
+			if err = encode(conn, msg); err != nil {
+				break
+			}
+			more := false
+			select {
+			case msg = <-out:
+				more = true
+			default:
+			}
+			if !more {
+				break
+			}
+		}
+		if err == nil {
+			conn.SetWriteDeadline(time.Now().Add(connWriteDeadline))
+			err = conn.Flush()
+		}
 		if err != nil {
 			log.Printf("send: %s: closing %s\n", err, conn.RemoteAddr())
 			conn.Close()
 			<-pleaseClose
-			closed <- true
+			close(closed)
 			log.Printf("send: closed %s\n", conn.RemoteAddr())
 			return
 		}
 	}
 }
+
+// Piece messages without data stand for blocks that are read from storage
+// when they are written
+func blockSize(msg pwp.Message) int {
+	if msg.Data == nil {
+		return int(msg.BlockLength)
+	}
+	return len(msg.Data)
+}
+
+func encode(conn *pwp.Conn, msg pwp.Message) error {
+	if msg.Typ == pwp.MessagePiece && msg.Data == nil {
+		return conn.EncodeBlock(msg.PieceIndex, msg.BlockOffset, msg.BlockLength)
+	}
+	return conn.Encode(msg)
+}
+
+// localIPv6 returns a global unicast IPv6 address of this host, or the empty
+// string if there is none
+func localIPv6() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("warning: listing interface addresses: %s\n", err)
+		return ""
+	}
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.To4() != nil || !n.IP.IsGlobalUnicast() || n.IP.IsPrivate() {
+			continue
+		}
+		return n.IP.String()
+	}
+	return ""
+}
@@ -4,182 +4,580 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/pieterkockx/bittorrent/bencode"
+	"github.com/pieterkockx/bittorrent/bitfield"
+	"github.com/pieterkockx/bittorrent/mse"
 	"github.com/pieterkockx/bittorrent/pwp"
 )
 
 const (
 	connWriteDeadline = 1 * time.Second
 	connReadDeadline  = 2 * time.Second
+	// The encryption handshake takes a few round trips
+	encryptionDeadline = 5 * time.Second
 )
 
 type peerInfo struct {
-	addr      string
-	peerID    [20]byte
-	piecesSet []bool
+	addr       string
+	peerID     [20]byte
+	pieces     *bitfield.Bitfield
+	extensions bool
+	// fast is set if both sides support the fast extension
+	fast bool
+	// outbound is set if we dialed the peer
+	outbound bool
 }
 
+// peerConn is a connection to a peer. It owns the state of the connection
+// (choked and interested in both directions, the pieces the peer has in
+// info.pieces and our outstanding requests), which receive keeps up to date
 type peerConn struct {
-	info   *peerInfo
-	in     chan pwp.Message
-	out    chan pwp.Message
-	closed chan bool
-}
-
-func unpackBitmap(b []byte) []bool {
-	m := make([]bool, len(b)*8)
-	for j := 0; j < len(b); j++ {
-		for i := 0; i < 8; i++ {
-			if b[j]&(1<<(8-uint(i+1))) > 0 {
-				m[8*j+i] = true
-			}
+	info *peerInfo
+	conn *pwp.Conn
+	out  chan pwp.Message
+	// requests receives the messages concerning uploads, blocks the replies
+	// to our requests
+	requests chan pwp.Message
+	blocks   chan pwp.Message
+	// uploadDone is closed when upload stops taking from requests
+	uploadDone chan struct{}
+	// changed is signalled when the peer chokes or unchokes us, or rejects a
+	// request
+	changed chan struct{}
+	closed  chan struct{}
+	picker  *picker
+	// bw limits the rates of this peer alone; upLimit and downLimit also
+	// include the limits of the torrent and the process
+	bw        bandwidth
+	upLimit   limiters
+	downLimit limiters
+	// interest serializes updates of our interest, so that the messages
+	// are sent in the same order as the changes
+	interest sync.Mutex
+	// started is set once the first message arrived; only receive
+	// touches it
+	started bool
+
+	connected time.Time
+	up        uploadState
+	dl        downloadState
+}
+
+// downloadState is the part of the connection state that concerns
+// downloading from the peer
+type downloadState struct {
+	sync.Mutex
+	amInterested bool
+	peerChoking  bool
+	requests     map[blockKey]bool
+	reqq         int
+	downloaded   int64
+	lastBlock    time.Time
+}
+
+func (p *peerConn) notify() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// updateInterest tells the peer whether we are interested, if that changed
+// since we last told it. We are interested as long as the peer has a piece
+// that we do not have
+func (p *peerConn) updateInterest() bool {
+	p.interest.Lock()
+	defer p.interest.Unlock()
+	interested := p.picker.interesting(p)
+	p.dl.Lock()
+	changed := interested != p.dl.amInterested
+	p.dl.amInterested = interested
+	p.dl.Unlock()
+	if !changed {
+		return true
+	}
+	typ := pwp.MessageNotInterested
+	if interested {
+		typ = pwp.MessageInterested
+	}
+	log.Printf("peer manager: sending %s message to %s\n", typ, p.info.addr)
+	return p.send(pwp.Message{Typ: typ})
+}
+
+// haves records that the peer has pieces, which may already be set
+func (p *peerConn) haves(pieces []int) {
+	added := make([]int, 0, len(pieces))
+	for _, i := range pieces {
+		if p.info.pieces.Set(i) {
+			added = append(added, i)
 		}
 	}
-	return m
+	if len(added) == 0 {
+		return
+	}
+	p.dl.Lock()
+	interested := p.dl.amInterested
+	p.dl.Unlock()
+	if p.picker.have(p, added...) && !interested {
+		p.updateInterest()
+	}
 }
 
-func packBitmap(m []bool) []byte {
-	l := len(m) / 8
-	if len(m)%8 != 0 {
-		l++
+// handle updates the connection state with a message from the peer and
+// passes the message on to whoever acts on it
+func (p *peerConn) handle(msg pwp.Message) error {
+	// The pieces of the peer may be sent as bitfield (or as have all or
+	// have none) only in the first message; a peer without pieces may send
+	// nothing at all
+	first := !p.started && msg.Typ != pwp.MessageKeepAlive
+	if first {
+		p.started = true
 	}
-	b := make([]byte, l)
-	for j := 0; j < l; j++ {
-		for i := 0; i < 8; i++ {
-			if 8*j+i < len(m) && m[8*j+i] {
-				b[j] |= 1 << (8 - uint(i+1))
+
+	switch msg.Typ {
+	case pwp.MessageKeepAlive:
+	case pwp.MessageChoke, pwp.MessageUnchoke:
+		p.dl.Lock()
+		p.dl.peerChoking = msg.Typ == pwp.MessageChoke
+		if p.dl.peerChoking && !p.info.fast {
+			// The peer drops our pending requests; with the fast
+			// extension it rejects them one by one instead
+			for k := range p.dl.requests {
+				p.picker.cancel(p, k)
 			}
+			p.dl.requests = map[blockKey]bool{}
+		}
+		p.dl.Unlock()
+		p.notify()
+	case pwp.MessageInterested, pwp.MessageNotInterested, pwp.MessageRequest, pwp.MessageCancel:
+		select {
+		case p.requests <- msg:
+		case <-p.uploadDone:
+			// The connection is being closed
+			return fmt.Errorf("%s message after uploading stopped", msg.Typ)
+		}
+	case pwp.MessageHave:
+		if int64(msg.PieceIndex) >= int64(p.info.pieces.Len()) {
+			return fmt.Errorf("%s message for piece %d out of range", msg.Typ, msg.PieceIndex)
+		}
+		p.haves([]int{int(msg.PieceIndex)})
+	case pwp.MessageBitfield:
+		if !first {
+			return fmt.Errorf("%s message is not the first message", msg.Typ)
+		}
+		pieces, err := bitfield.Unpack(msg.Data, p.info.pieces.Len())
+		if err != nil {
+			return fmt.Errorf("%s message: %s", msg.Typ, err)
+		}
+		p.haves(pieces.Pieces())
+	case pwp.MessageHaveAll, pwp.MessageHaveNone:
+		if !p.info.fast {
+			return fmt.Errorf("unexpected %s message without fast extension", msg.Typ)
+		}
+		if !first {
+			return fmt.Errorf("%s message is not the first message", msg.Typ)
+		}
+		if msg.Typ == pwp.MessageHaveAll {
+			p.haves(bitfield.NewFull(p.info.pieces.Len()).Pieces())
+		}
+	case pwp.MessageRejectRequest:
+		if !p.info.fast {
+			return fmt.Errorf("unexpected %s message without fast extension", msg.Typ)
+		}
+		k := blockKey{msg.PieceIndex, msg.BlockOffset}
+		p.dl.Lock()
+		requested := p.dl.requests[k]
+		if requested {
+			delete(p.dl.requests, k)
+			p.picker.cancel(p, k)
 		}
+		p.dl.Unlock()
+		if requested {
+			p.notify()
+		}
+	case pwp.MessageSuggest, pwp.MessageAllowedFast:
+		if !p.info.fast {
+			return fmt.Errorf("unexpected %s message without fast extension", msg.Typ)
+		}
+		// We only request while unchoked and pick pieces ourselves
+	case pwp.MessagePiece:
+		k := blockKey{msg.PieceIndex, msg.BlockOffset}
+		p.dl.Lock()
+		requested := p.dl.requests[k]
+		if requested {
+			delete(p.dl.requests, k)
+			p.dl.downloaded += int64(len(msg.Data))
+			p.dl.lastBlock = time.Now()
+		}
+		p.dl.Unlock()
+		if !requested {
+			log.Printf("receive: block of piece %d (offset %d) from %s was not requested (anymore): discarding\n", msg.PieceIndex, msg.BlockOffset, p.info.addr)
+			pwp.Release(msg)
+			break
+		}
+		// Never blocks, as there are no more blocks in flight than the
+		// channel holds
+		p.blocks <- msg
+	case pwp.MessageExtended:
+		if msg.ExtendedID != pwp.ExtendedHandshakeID {
+			log.Printf("receive: unknown extended message %d from %s: discarding\n", msg.ExtendedID, p.info.addr)
+			break
+		}
+		h, err := parseExtendedHandshake(msg.Data)
+		if err != nil {
+			log.Printf("receive: %s from %s: discarding\n", err, p.info.addr)
+			break
+		}
+		p.dl.Lock()
+		p.dl.reqq = h.reqq
+		p.dl.Unlock()
+	default:
+		log.Printf("receive: unexpected %s message from %s: discarding\n", msg.Typ, p.info.addr)
 	}
-	return b
+	return nil
 }
 
-func shakeHands(c client, addr string) (peerInfo, net.Conn, error) {
-	var b []byte
-	var n int
+// close closes the underlying connection; the receive and send goroutines
+// notice and close p.closed
+func (p *peerConn) close() {
+	p.conn.Close()
+}
 
-	conn, err := net.DialTimeout("tcp", addr, 5000000000)
-	if err != nil {
-		return peerInfo{}, nil, fmt.Errorf("%s", err)
+// send queues msg for sending and reports false if the connection was closed
+// in the meantime
+func (p *peerConn) send(msg pwp.Message) bool {
+	select {
+	case p.out <- msg:
+		return true
+	case <-p.closed:
+		return false
 	}
+}
 
-	b = pwp.Handshake{InfoHash: c.infoHash, PeerID: c.peerID}.Marshal()
+func writeHandshake(c client, conn net.Conn) error {
+	h := pwp.Handshake{InfoHash: c.infoHash, PeerID: c.peerID}
+	h.SetExtensions()
+	h.SetFast()
+	b := h.Marshal()
 	conn.SetWriteDeadline(time.Now().Add(connWriteDeadline))
-	n, err = conn.Write(b)
+	n, err := conn.Write(b)
 	if err != nil {
-		conn.Close()
-		return peerInfo{}, nil, fmt.Errorf("reading handshake (wrote %d [of %d] bytes): %s", n, len(b), err)
+		return fmt.Errorf("writing handshake (wrote %d [of %d] bytes): %s", n, len(b), err)
 	}
+	return nil
+}
 
+func readHandshake(c client, conn net.Conn) (pwp.Handshake, error) {
 	conn.SetReadDeadline(time.Now().Add(connReadDeadline))
 	remote, err := pwp.ReadHandshake(conn)
 	if err != nil {
-		conn.Close()
-		return peerInfo{}, nil, fmt.Errorf("reading handshake: %s", err)
+		return pwp.Handshake{}, fmt.Errorf("reading handshake: %s", err)
 	}
+	if remote.InfoHash != c.infoHash {
+		return pwp.Handshake{}, fmt.Errorf("handshake has wrong info hash %x", remote.InfoHash)
+	}
+	if remote.PeerID == c.peerID {
+		return pwp.Handshake{}, fmt.Errorf("connected to ourselves")
+	}
+	return remote, nil
+}
 
-	b = pwp.Message{Typ: pwp.MessageBitfield, Data: packBitmap(c.piecesSet)}.Marshal()
-	conn.SetWriteDeadline(time.Now().Add(connWriteDeadline))
-	n, err = conn.Write(b)
+// shakeHands performs the handshake on conn, as the initiator if outbound is
+// set or else as the responder (reading the remote handshake first), and
+// exchanges bitfields. The connection is closed on error
+func shakeHands(c client, conn net.Conn, addr string, outbound bool) (peerInfo, error) {
+	var remote pwp.Handshake
+	var err error
+
+	if outbound {
+		err = writeHandshake(c, conn)
+		if err == nil {
+			remote, err = readHandshake(c, conn)
+		}
+	} else {
+		remote, err = readHandshake(c, conn)
+		if err == nil {
+			err = writeHandshake(c, conn)
+		}
+	}
 	if err != nil {
 		conn.Close()
-		return peerInfo{}, nil, fmt.Errorf("writing %s message (wrote %d [of %d] bytes): %s", pwp.MessageBitfield, n, len(b), err)
+		return peerInfo{}, err
 	}
 
-	conn.SetReadDeadline(time.Now().Add(connReadDeadline))
-	m, err := pwp.ReadMessage(conn)
+	// The bitfield is optional if we have no pieces, unless the peer
+	// supports the fast extension, which requires one of bitfield, have
+	// all or have none
+	fast := remote.SupportsFast()
+	var first []pwp.Message
+	switch {
+	case fast && c.pieces.Full():
+		first = append(first, pwp.Message{Typ: pwp.MessageHaveAll})
+	case fast && c.pieces.Count() == 0:
+		first = append(first, pwp.Message{Typ: pwp.MessageHaveNone})
+	case c.pieces.Count() > 0:
+		first = append(first, pwp.Message{Typ: pwp.MessageBitfield, Data: c.pieces.Pack()})
+	}
+	for _, msg := range first {
+		b := msg.Marshal()
+		conn.SetWriteDeadline(time.Now().Add(connWriteDeadline))
+		n, err := conn.Write(b)
+		if err != nil {
+			conn.Close()
+			return peerInfo{}, fmt.Errorf("writing %s message (wrote %d [of %d] bytes): %s", msg.Typ, n, len(b), err)
+		}
+	}
+
+	// The pieces of the peer follow from the first message it sends, which
+	// handle takes care of
+	pieces := bitfield.New(c.pieces.Len())
+	return peerInfo{addr: addr, peerID: remote.PeerID, pieces: pieces, extensions: remote.SupportsExtensions(), fast: fast, outbound: outbound}, nil
+}
+
+func (s *swarm) addPeer(addr string) (*peerConn, error) {
+	conn, err := s.dial(addr)
 	if err != nil {
-		conn.Close()
-		return peerInfo{}, nil, fmt.Errorf("reading message: %s", err)
+		return nil, err
 	}
-	if m.Typ != pwp.MessageBitfield {
-		conn.Close()
-		return peerInfo{}, nil, fmt.Errorf("expected %s message, got %s message instead", pwp.MessageBitfield, m.Typ)
+	if s.encryption == mse.PlaintextOnly {
+		return s.startPeer(conn, addr, true)
 	}
-	piecesSet := unpackBitmap(m.Data)[:len(c.piecesSet)]
+	enc, err := encrypt(conn, s.c.infoHash, s.encryption, true)
+	if err == nil {
+		return s.startPeer(enc, addr, true)
+	}
+	if s.encryption == mse.RequireEncrypted {
+		return nil, err
+	}
+	// The peer may not support encryption at all, in which case it has
+	// hung up or answered in plaintext, so start over
+	conn, err = s.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.startPeer(conn, addr, true)
+}
+
+func (s *swarm) acceptPeer(conn net.Conn) (*peerConn, error) {
+	enc, err := encrypt(conn, s.c.infoHash, s.encryption, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.startPeer(enc, conn.RemoteAddr().String(), false)
+}
 
-	return peerInfo{addr: addr, peerID: remote.PeerID, piecesSet: piecesSet}, conn, nil
+// encrypt performs the encryption handshake on conn, as the initiator if
+// outbound is set. The connection is closed on error
+func encrypt(conn net.Conn, infoHash [20]byte, policy mse.Policy, outbound bool) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(encryptionDeadline))
+	var enc net.Conn
+	var err error
+	if outbound {
+		enc, err = mse.Client(conn, infoHash, policy)
+	} else {
+		enc, err = mse.Server(conn, infoHash, policy)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("encryption handshake: %s", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return enc, nil
 }
 
-func addPeer(c client, addr string) (*peerConn, error) {
-	info, conn, err := shakeHands(c, addr)
+func (s *swarm) startPeer(conn net.Conn, addr string, outbound bool) (*peerConn, error) {
+	c := s.c
+	info, err := shakeHands(c, conn, addr, outbound)
 	if err != nil {
 		return nil, fmt.Errorf("shaking hands: %s", err)
 	}
 
-	in := make(chan pwp.Message)
+	limits := pwp.Limits{
+		Pieces: c.pieces.Len(),
+		// Blocks of any size we would serve ourselves are read, even if
+		// we only request blockLength bytes
+		MaxBlock:    maxRequestLength,
+		MaxExtended: maxExtendedLength,
+	}
+	wire := pwp.NewConn(conn, limits, s.m)
 	out := make(chan pwp.Message)
-	p := peerConn{&info, in, out, make(chan bool)}
-
-	pleaseClose := make(chan bool)
-	go receive(conn, pleaseClose)
-	go send(conn, out, pleaseClose, p.closed)
+	s.mu.Lock()
+	bw := newBandwidth(s.limits.peerUp, s.limits.peerDown)
+	s.mu.Unlock()
+	p := peerConn{
+		info:       &info,
+		conn:       wire,
+		out:        out,
+		requests:   make(chan pwp.Message, 64),
+		blocks:     make(chan pwp.Message, maxRequestQueue),
+		uploadDone: make(chan struct{}),
+		changed:    make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+		picker:     s.picker,
 
-	expect(in, pwp.Message{Typ: pwp.MessageUnchoke})
+		bw:        bw,
+		upLimit:   limiters{bw.up, s.bw.up, globalBandwidth.up},
+		downLimit: limiters{bw.down, s.bw.down, globalBandwidth.down},
 
-	log.Printf("peer manager: sending %s message to %s\n", pwp.MessageInterested, conn.RemoteAddr())
-	out <- pwp.Message{Typ: pwp.MessageInterested}
+		connected: time.Now(),
+		up:        uploadState{amChoking: true},
+		dl: downloadState{
+			peerChoking: true,
+			requests:    map[blockKey]bool{},
+			reqq:        defaultPeerReqq,
+		},
+	}
 
-	timeout := 5 * time.Second
-	select {
-	case <-in:
-		log.Printf("peer manager: received %s message from %s\n", pwp.MessageUnchoke, conn.RemoteAddr())
-	case <-time.After(timeout):
-		conn.Close()
+	// Register before starting to receive so that an early have is not lost
+	s.picker.addPeer(&p, info.pieces)
+	go func() {
 		<-p.closed
-		return nil, fmt.Errorf("timed out waiting for %s message from %s", pwp.MessageUnchoke, conn.RemoteAddr())
+		s.picker.removePeer(&p)
+	}()
+
+	pleaseClose := make(chan bool)
+	go receive(&p, pleaseClose)
+	go send(wire, out, p.upLimit, pleaseClose, p.closed)
+
+	if info.extensions {
+		out <- makeExtendedHandshake(c)
 	}
 
 	return &p, nil
 }
 
-func managePeers(c client, m metainfo, hosts []string, peers chan *peerConn) {
+const (
+	defaultAnnounceInterval = 2 * time.Minute
+	// stopTimeout bounds how long we wait on the announces made on exit
+	stopTimeout = 2 * defaultTrackerTimeout
+)
+
+func parseTrackerInterval(d map[string]interface{}) time.Duration {
+	i, b := d["interval"].(int64)
+	if !b || i <= 0 {
+		return defaultAnnounceInterval
+	}
+	return time.Duration(i) * time.Second
+}
+
+// managePeers announces to the trackers and passes the peer addresses they
+// return on to addrs, re-announcing every interval the tracker asks for. Once
+// all trackers failed it gives up, unless retry is set. When done is closed
+// during the download, the tracker learns right away that we completed it.
+// When stop is closed, it tells the tracker that we stop and returns
+func managePeers(c client, m metainfo, hosts []string, addrs chan string, done, stop chan struct{}, retry bool) {
 	log.Printf("peer manager: started\n")
 
+	// Starting out complete is not completing the download
+	select {
+	case <-done:
+		done = nil
+	default:
+	}
+	event := ""
+
+	supported := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		if !canAnnounce(h) {
+			log.Printf("peer manager: skipping tracker %s: unsupported URL scheme\n", h)
+			continue
+		}
+		supported = append(supported, h)
+	}
+	hosts = supported
+	if len(hosts) == 0 {
+		if !retry {
+			log.Fatalln("peer manager: no tracker to announce to, giving up")
+		}
+		log.Printf("peer manager: no tracker to announce to\n")
+		return
+	}
+	if len(hosts) > 1 {
+		hosts = c.tracker.rank(c.infoHash, hosts)
+	}
+
+	// last is the tracker that last answered our announce
+	last := ""
 	i := -1
 	for {
 		i++
 		if i == len(hosts) {
-			log.Fatalln("peer manager: tried all trackers, giving up")
+			if !retry {
+				log.Fatalln("peer manager: tried all trackers, giving up")
+			}
+			log.Printf("peer manager: tried all trackers, trying again in %s\n", defaultAnnounceInterval)
+			select {
+			case <-time.After(defaultAnnounceInterval):
+			case <-stop:
+				leave(c, m, last, done, event)
+				return
+			}
 			i = 0
 		}
 		for {
 			log.Printf("peer manager: trying tracker %s\n", hosts[i])
-			b, err := announceToTracker(c, m, hosts[i])
+			b, err := c.tracker.announce(c, m, hosts[i], event)
 			if err != nil {
 				log.Printf("peer manager: announcing: %s\n", err)
 				break
 			}
+			event = ""
 			d, err := bencode.UnmarshalDict(b)
 			if err != nil {
 				log.Printf("peer manager: unmarshaling tracker response: %s\n", err)
 				break
 			}
-			addrs, err := parseTrackerResponse(d)
+			peers, err := parseTrackerResponse(d)
 			if err != nil {
 				log.Printf("peer manager: parsing tracker response: %s\n", err)
 				break
 			}
+			last = hosts[i]
+			interval := parseTrackerInterval(d)
 
-			log.Printf("peer manager: got %d peer addresses from tracker\n", len(addrs))
-			for i := 0; i < len(addrs); i++ {
-				peer, err := addPeer(c, addrs[i])
-				if err != nil {
-					log.Printf("peer manager: adding peer: %s\n", err)
-					continue
-				}
-				log.Printf("peer manager: succesfully connected to %s\n", addrs[i])
-				peers <- peer
-				log.Printf("peer manager: %s passed on, waiting for it to close\n", addrs[i])
-				<-peer.closed
-				log.Printf("peer manager: connection to %s was closed\n", addrs[i])
+			log.Printf("peer manager: got %d peer addresses from tracker\n", len(peers))
+			for j := 0; j < len(peers); j++ {
+				addrs <- peers[j]
 			}
-			if len(addrs) == 0 {
-				break
+			log.Printf("peer manager: announcing again in %s\n", interval)
+			select {
+			case <-time.After(interval):
+			case <-done:
+				done = nil
+				event = "completed"
+				log.Printf("peer manager: download completed: announcing now\n")
+			case <-stop:
+				leave(c, m, last, done, event)
+				return
 			}
 		}
 		log.Printf("peer manager: trying next tracker\n")
 	}
 }
+
+// leave tells host that we stop, after telling it that we completed the
+// download if that has not been announced yet
+func leave(c client, m metainfo, host string, done chan struct{}, event string) {
+	if host == "" {
+		return
+	}
+	select {
+	case <-done:
+		// done is nil once completion was handled
+		event = "completed"
+	default:
+	}
+	if event == "completed" {
+		log.Printf("peer manager: announcing completion to %s\n", host)
+		if _, err := c.tracker.announce(c, m, host, event); err != nil {
+			log.Printf("peer manager: announcing: %s\n", err)
+		}
+	}
+	log.Printf("peer manager: announcing that we stop to %s\n", host)
+	if _, err := c.tracker.announce(c, m, host, "stopped"); err != nil {
+		log.Printf("peer manager: announcing: %s\n", err)
+	}
+}
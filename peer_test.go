@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pieterkockx/bittorrent/bitfield"
+	"github.com/pieterkockx/bittorrent/pwp"
+)
+
+func TestHandleAfterUploadStopped(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	p := newTestPeer(0)
+	p.conn = pwp.NewConn(a, pwp.Limits{}, nil)
+	p.requests = make(chan pwp.Message, 64)
+	p.uploadDone = make(chan struct{})
+	p.up.amChoking = false
+	c := client{pieces: bitfield.NewFull(4), transferred: &transferStats{}}
+	go upload(c, testMetainfo(), p, newChoker(1, 0))
+
+	// An invalid request stops upload; the requests pipelined after it
+	// must not block the receiving side
+	errc := make(chan error, 1)
+	go func() {
+		if err := p.handle(pwp.Message{Typ: pwp.MessageRequest, PieceIndex: 99, BlockLength: 1}); err != nil {
+			errc <- err
+			return
+		}
+		for i := 0; i < 1000; i++ {
+			if err := p.handle(pwp.Message{Typ: pwp.MessageRequest, PieceIndex: 0, BlockLength: 1}); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Errorf("requests were still taken after uploading stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handing over requests blocked after uploading stopped")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	clientID          = "PK"
+	peerIDSuffixChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+)
+
+// version is overridden at build time with
+// go build -ldflags "-X main.version=1.2.3"
+var version = "0.1.0"
+
+// versionSegment encodes version as the four characters of an Azureus-style
+// peer ID: one base 36 digit per component (major, minor, patch, build)
+func versionSegment(v string) string {
+	s := ""
+	fields := strings.SplitN(strings.TrimPrefix(v, "v"), ".", 4)
+	for i := 0; i < 4; i++ {
+		n := int64(0)
+		if i < len(fields) {
+			f := fields[i]
+			// Ignore suffixes such as "-rc1" or "+dirty"
+			if j := strings.IndexAny(f, "-+"); j != -1 {
+				f = f[:j]
+			}
+			n, _ = strconv.ParseInt(f, 10, 64)
+		}
+		if n < 0 || n >= 36 {
+			n = 35
+		}
+		s += strconv.FormatInt(n, 36)
+	}
+	return s
+}
+
+func defaultPeerIDPrefix() string {
+	return "-" + clientID + versionSegment(version) + "-"
+}
+
+// makePeerID returns a peer ID starting with prefix followed by random
+// alphanumeric characters, so that every session has its own ID
+func makePeerID(prefix string) ([20]byte, error) {
+	var id [20]byte
+	if len(prefix) > len(id) {
+		return id, fmt.Errorf("peer ID prefix %q longer than %d bytes", prefix, len(id))
+	}
+	copy(id[:], prefix)
+	r := make([]byte, len(id)-len(prefix))
+	_, err := rand.Read(r)
+	if err != nil {
+		return id, fmt.Errorf("reading random bytes: %s", err)
+	}
+	for i := 0; i < len(r); i++ {
+		id[len(prefix)+i] = peerIDSuffixChars[int(r[i])%len(peerIDSuffixChars)]
+	}
+	return id, nil
+}
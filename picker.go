@@ -0,0 +1,305 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+
+	"github.com/pieterkockx/bittorrent/bitfield"
+)
+
+// Until we have this many pieces, pick at random rather than rarest first so
+// that we quickly get something to trade with
+const randomFirstPieces = 4
+
+type picker struct {
+	sync.Mutex
+	m metainfo
+	// pieces is the client's pieces set, which the picker updates
+	pieces *bitfield.Bitfield
+	avail  []int
+	peers  map[*peerConn]*bitfield.Bitfield
+
+	// downloading holds the pieces of which blocks have been requested
+	downloading map[uint32]*pieceDownload
+	// unrequested counts the blocks of missing pieces that are neither
+	// requested nor received; once it drops to zero we are in endgame mode
+	unrequested int
+
+	// changed is closed and replaced whenever a block may have become
+	// available to request, or a block that may be outstanding was received
+	changed chan struct{}
+	done    chan struct{}
+}
+
+func newPicker(m metainfo, pieces *bitfield.Bitfield, done chan struct{}) *picker {
+	pk := &picker{
+		m:           m,
+		pieces:      pieces,
+		avail:       make([]int, pieces.Len()),
+		peers:       map[*peerConn]*bitfield.Bitfield{},
+		downloading: map[uint32]*pieceDownload{},
+		changed:     make(chan struct{}),
+		done:        done,
+	}
+	for _, i := range pieces.Missing() {
+		pk.unrequested += numBlocks(m.pieceSize(uint32(i)))
+	}
+	if pieces.Full() {
+		close(done)
+	}
+	return pk
+}
+
+// wake must be called with pk held
+func (pk *picker) wake() {
+	close(pk.changed)
+	pk.changed = make(chan struct{})
+}
+
+// wait returns a channel that is closed when requesting may succeed again
+func (pk *picker) wait() chan struct{} {
+	pk.Lock()
+	defer pk.Unlock()
+	return pk.changed
+}
+
+// addPeer registers p with the pieces it has. The pieces set is that of the
+// connection; pieces the peer announces later are counted by have
+func (pk *picker) addPeer(p *peerConn, set *bitfield.Bitfield) {
+	pk.Lock()
+	defer pk.Unlock()
+	for _, i := range set.Pieces() {
+		pk.avail[i]++
+	}
+	pk.peers[p] = set
+	pk.wake()
+}
+
+func (pk *picker) removePeer(p *peerConn) {
+	pk.Lock()
+	defer pk.Unlock()
+	set, has := pk.peers[p]
+	if !has {
+		return
+	}
+	for _, i := range set.Pieces() {
+		pk.avail[i]--
+	}
+	delete(pk.peers, p)
+}
+
+// have records that p announced pieces, which were just set in its pieces
+// set. It reports whether we are missing any of them
+func (pk *picker) have(p *peerConn, pieces ...int) bool {
+	pk.Lock()
+	defer pk.Unlock()
+	if _, has := pk.peers[p]; !has {
+		return false
+	}
+	missing := false
+	for _, i := range pieces {
+		pk.avail[i]++
+		if !pk.pieces.Has(i) {
+			missing = true
+		}
+	}
+	if missing {
+		pk.wake()
+	}
+	return missing
+}
+
+// interesting reports whether p has a piece that we do not have
+func (pk *picker) interesting(p *peerConn) bool {
+	pk.Lock()
+	set, has := pk.peers[p]
+	pk.Unlock()
+	return has && set.HasAnyMissingFrom(pk.pieces)
+}
+
+// pickPiece returns a piece in set that we neither have nor are downloading,
+// preferring the rarest one (ties are broken at random). Must be called with
+// pk held
+func (pk *picker) pickPiece(set *bitfield.Bitfield) (uint32, bool) {
+	random := pk.pieces.Count() < randomFirstPieces
+	best := -1
+	n := 0
+	for _, i := range set.Pieces() {
+		if pk.pieces.Has(i) {
+			continue
+		}
+		if _, has := pk.downloading[uint32(i)]; has {
+			continue
+		}
+		if !random && best != -1 && pk.avail[i] > pk.avail[best] {
+			continue
+		}
+		if !random && best != -1 && pk.avail[i] < pk.avail[best] {
+			n = 0
+		}
+		// Reservoir sampling among the candidates seen so far
+		n++
+		if rand.Intn(n) == 0 {
+			best = i
+		}
+	}
+	if best == -1 {
+		return 0, false
+	}
+	return uint32(best), true
+}
+
+// request returns a block for p to request and records p as requesting it.
+// Unrequested blocks of pieces in progress come first, then a newly picked
+// piece; in endgame mode p gets a block that other peers requested already
+func (pk *picker) request(p *peerConn) (blockKey, uint32, bool) {
+	pk.Lock()
+	defer pk.Unlock()
+	set, has := pk.peers[p]
+	if !has {
+		return blockKey{}, 0, false
+	}
+
+	for _, pd := range pk.downloading {
+		if !set.Has(int(pd.index)) {
+			continue
+		}
+		for b := 0; b < pd.nblocks; b++ {
+			if !pd.received[b] && len(pd.requesters[b]) == 0 {
+				return pk.markRequested(p, pd, b)
+			}
+		}
+	}
+
+	if i, ok := pk.pickPiece(set); ok {
+		pd := newPieceDownload(i, pk.m.pieceSize(i))
+		pk.downloading[i] = pd
+		return pk.markRequested(p, pd, 0)
+	}
+
+	if pk.unrequested > 0 {
+		return blockKey{}, 0, false
+	}
+
+	// Endgame: the block with the fewest requesters that p did not request
+	var best *pieceDownload
+	bestBlock := -1
+	for _, pd := range pk.downloading {
+		if !set.Has(int(pd.index)) {
+			continue
+		}
+		for b := 0; b < pd.nblocks; b++ {
+			if pd.received[b] || pd.requestedBy(b, p) {
+				continue
+			}
+			if best == nil || len(pd.requesters[b]) < len(best.requesters[bestBlock]) {
+				best, bestBlock = pd, b
+			}
+		}
+	}
+	if best == nil {
+		return blockKey{}, 0, false
+	}
+	return pk.markRequested(p, best, bestBlock)
+}
+
+// markRequested must be called with pk held
+func (pk *picker) markRequested(p *peerConn, pd *pieceDownload, b int) (blockKey, uint32, bool) {
+	if len(pd.requesters[b]) == 0 {
+		pk.unrequested--
+		if pk.unrequested == 0 {
+			log.Printf("picker: all blocks requested: entering endgame mode\n")
+			// Idle peers may now request blocks in endgame mode
+			pk.wake()
+		}
+	}
+	pd.requesters[b] = append(pd.requesters[b], p)
+	offs, l := pd.block(b)
+	return blockKey{pd.index, offs}, l, true
+}
+
+// requested reports whether the request of p for block k still stands, that
+// is, nobody else received the block in the meantime
+func (pk *picker) requested(p *peerConn, k blockKey) bool {
+	pk.Lock()
+	defer pk.Unlock()
+	pd, has := pk.downloading[k.index]
+	if !has {
+		return false
+	}
+	return pd.requestedBy(int(k.offset/blockLength), p)
+}
+
+// cancel withdraws the request of p for block k, e.g. because it timed out
+func (pk *picker) cancel(p *peerConn, k blockKey) {
+	pk.Lock()
+	defer pk.Unlock()
+	pd, has := pk.downloading[k.index]
+	if !has {
+		return
+	}
+	b := int(k.offset / blockLength)
+	if !pd.removeRequester(b, p) {
+		return
+	}
+	if len(pd.requesters[b]) == 0 && !pd.received[b] {
+		pk.unrequested++
+		pk.wake()
+	}
+}
+
+// receive stores block k sent by p. It returns the other peers that requested
+// the block, which should be sent a cancel, and the piece if it is now
+// complete. Blocks that we did not request from p are dropped
+func (pk *picker) receive(p *peerConn, k blockKey, data []byte) ([]*peerConn, *pieceDownload) {
+	pk.Lock()
+	defer pk.Unlock()
+	pd, has := pk.downloading[k.index]
+	if !has {
+		return nil, nil
+	}
+	b := int(k.offset / blockLength)
+	if !pd.removeRequester(b, p) || pd.received[b] {
+		return nil, nil
+	}
+	copy(pd.data[k.offset:], data)
+	pd.received[b] = true
+	pd.senders[b] = p.info.addr
+	pd.nreceived++
+
+	others := pd.requesters[b]
+	pd.requesters[b] = nil
+	if len(others) > 0 {
+		// Let the other requesters notice that their request is void
+		pk.wake()
+	}
+	if pd.nreceived < pd.nblocks {
+		return others, nil
+	}
+	return others, pd
+}
+
+// finish marks a complete piece as set, or starts it over if it turned out
+// to be corrupt (or could not be stored)
+func (pk *picker) finish(index uint32, ok bool) {
+	pk.Lock()
+	defer pk.Unlock()
+	pd, has := pk.downloading[index]
+	if !has {
+		return
+	}
+	delete(pk.downloading, index)
+	if !ok {
+		pk.unrequested += pd.nblocks
+		pk.wake()
+		return
+	}
+	if !pk.pieces.Set(int(index)) {
+		return
+	}
+	if pk.pieces.Full() {
+		log.Printf("picker: got all %d pieces\n", pk.pieces.Len())
+		close(pk.done)
+	}
+}
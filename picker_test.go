@@ -0,0 +1,246 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pieterkockx/bittorrent/bitfield"
+	"github.com/pieterkockx/bittorrent/pwp"
+)
+
+// blocksMetainfo returns a torrent of n pieces of the given number of blocks
+func blocksMetainfo(n, blocks int) metainfo {
+	return metainfo{
+		pieceHashes: make([][20]byte, n),
+		pieceLength: uint32(blocks) * blockLength,
+		totalSize:   int64(n*blocks) * int64(blockLength),
+	}
+}
+
+func testSet(n int, pieces ...int) *bitfield.Bitfield {
+	set := bitfield.New(n)
+	for _, i := range pieces {
+		set.Set(i)
+	}
+	return set
+}
+
+func TestPickRarestFirst(t *testing.T) {
+	// Having randomFirstPieces pieces, the rarest ones come first
+	pk := newPicker(blocksMetainfo(8, 1), testSet(8, 0, 1, 2, 3), make(chan struct{}))
+	p := newTestPeer(0)
+	pk.addPeer(p, bitfield.NewFull(8))
+	pk.addPeer(newTestPeer(1), testSet(8, 4, 5, 6))
+	pk.addPeer(newTestPeer(2), testSet(8, 4, 5))
+	pk.addPeer(newTestPeer(3), testSet(8, 4))
+
+	for _, expected := range []uint32{7, 6, 5, 4} {
+		k, _, ok := pk.request(p)
+		if !ok || k.index != expected {
+			t.Fatalf("got piece %d (%t), expected %d", k.index, ok, expected)
+		}
+	}
+	if k, _, ok := pk.request(p); ok {
+		t.Errorf("got piece %d, expected none left", k.index)
+	}
+}
+
+func TestPickRandomFirst(t *testing.T) {
+	// Piece 7 is the rarest, but without pieces to trade any piece will do
+	for i := 0; i < 100; i++ {
+		pk := newPicker(blocksMetainfo(8, 1), bitfield.New(8), make(chan struct{}))
+		p := newTestPeer(0)
+		pk.addPeer(p, bitfield.NewFull(8))
+		pk.addPeer(newTestPeer(1), testSet(8, 0, 1, 2, 3, 4, 5, 6))
+		if k, _, _ := pk.request(p); k.index != 7 {
+			return
+		}
+	}
+	t.Errorf("always picked the rarest piece first")
+}
+
+func TestPickerAvailability(t *testing.T) {
+	pk := newPicker(blocksMetainfo(4, 1), testSet(4, 0), make(chan struct{}))
+	expect := func(avail ...int) {
+		t.Helper()
+		for i, a := range avail {
+			if pk.avail[i] != a {
+				t.Fatalf("got availability %v, expected %v", pk.avail, avail)
+			}
+		}
+	}
+	p, q := newTestPeer(0), newTestPeer(1)
+	pset := testSet(4, 0)
+	pk.addPeer(p, pset)
+	pk.addPeer(q, testSet(4, 0, 1))
+	expect(2, 1, 0, 0)
+	if pk.interesting(p) || !pk.interesting(q) {
+		t.Errorf("got interesting %t and %t, expected false and true", pk.interesting(p), pk.interesting(q))
+	}
+
+	pset.Set(1)
+	if !pk.have(p, 1) {
+		t.Errorf("have of a missing piece reports nothing we miss")
+	}
+	if !pk.interesting(p) {
+		t.Errorf("peer not interesting after announcing a missing piece")
+	}
+	expect(2, 2, 0, 0)
+
+	pk.removePeer(q)
+	expect(1, 1, 0, 0)
+	// Peers that are gone are not counted again
+	pk.removePeer(q)
+	if pk.have(q, 2) {
+		t.Errorf("have of a removed peer reports missing pieces")
+	}
+	expect(1, 1, 0, 0)
+}
+
+func TestPickerBookkeeping(t *testing.T) {
+	done := make(chan struct{})
+	pk := newPicker(blocksMetainfo(2, 2), bitfield.New(2), done)
+	p, q := newTestPeer(0), newTestPeer(1)
+	pk.addPeer(p, bitfield.NewFull(2))
+	pk.addPeer(q, bitfield.NewFull(2))
+	if pk.unrequested != 4 {
+		t.Fatalf("got %d unrequested blocks, expected 4", pk.unrequested)
+	}
+
+	k, l, _ := pk.request(p)
+	if l != blockLength || pk.unrequested != 3 || !pk.requested(p, k) {
+		t.Fatalf("got length %d and %d unrequested blocks, expected %d and 3", l, pk.unrequested, blockLength)
+	}
+	// A withdrawn request is handed out again first
+	pk.cancel(p, k)
+	if pk.unrequested != 4 || pk.requested(p, k) {
+		t.Fatalf("got %d unrequested blocks after cancel, expected 4", pk.unrequested)
+	}
+	if k2, _, _ := pk.request(q); k2 != k {
+		t.Fatalf("got block %v after cancel, expected %v", k2, k)
+	}
+
+	// Blocks that were not requested from the sender are dropped
+	data := make([]byte, blockLength)
+	if others, pd := pk.receive(p, k, data); others != nil || pd != nil || pk.downloading[k.index].received[0] {
+		t.Fatalf("block not requested from the sender was stored")
+	}
+	if others, pd := pk.receive(q, k, data); len(others) != 0 || pd != nil {
+		t.Fatalf("got %d other requesters and piece %v, expected neither", len(others), pd)
+	}
+	k2, _, _ := pk.request(q)
+	if k2.index != k.index || k2.offset != blockLength {
+		t.Fatalf("got block %v, expected the rest of piece %d", k2, k.index)
+	}
+	_, pd := pk.receive(q, k2, data)
+	if pd == nil {
+		t.Fatalf("piece not complete after receiving all blocks")
+	}
+
+	// A corrupt piece is requested all over again
+	pk.finish(pd.index, false)
+	if pk.unrequested != 4 {
+		t.Fatalf("got %d unrequested blocks after a corrupt piece, expected 4", pk.unrequested)
+	}
+	for i := 0; i < 4; i++ {
+		k, _, ok := pk.request(p)
+		if !ok {
+			t.Fatalf("no block left to request after %d", i)
+		}
+		if _, pd := pk.receive(p, k, data); pd != nil {
+			pk.finish(pd.index, true)
+		}
+	}
+	select {
+	case <-done:
+	default:
+		t.Errorf("done not closed after finishing all pieces")
+	}
+	if !pk.pieces.Full() {
+		t.Errorf("got pieces %v, expected all", pk.pieces.Pieces())
+	}
+}
+
+func TestEndgame(t *testing.T) {
+	pk := newPicker(blocksMetainfo(1, 2), bitfield.New(1), make(chan struct{}))
+	p, q := newTestPeer(0), newTestPeer(1)
+	pk.addPeer(p, bitfield.NewFull(1))
+	pk.addPeer(q, bitfield.NewFull(1))
+
+	// Entering endgame wakes up the peers that had nothing to request
+	changed := pk.wait()
+	k0, _, _ := pk.request(p)
+	k1, _, _ := pk.request(p)
+	select {
+	case <-changed:
+	default:
+		t.Errorf("peers not woken up on entering endgame")
+	}
+	if _, _, ok := pk.request(p); ok {
+		t.Errorf("got a block that was already requested from the same peer")
+	}
+	// In endgame mode the other peer asks for the same blocks
+	for i := 0; i < 2; i++ {
+		if _, _, ok := pk.request(q); !ok {
+			t.Fatalf("no block in endgame mode")
+		}
+	}
+	if !pk.requested(q, k0) || !pk.requested(q, k1) {
+		t.Fatalf("blocks not requested from both peers in endgame mode")
+	}
+
+	// The first to deliver has the others cancel their request
+	others, _ := pk.receive(p, k0, make([]byte, blockLength))
+	if len(others) != 1 || others[0] != q {
+		t.Fatalf("got %d others to cancel, expected the other peer", len(others))
+	}
+	if pk.requested(q, k0) {
+		t.Errorf("request of the other peer still stands after the block arrived")
+	}
+	if others, pd := pk.receive(q, k0, make([]byte, blockLength)); others != nil || pd != nil {
+		t.Errorf("block that arrived twice was stored twice")
+	}
+}
+
+func TestDownloadCancelsDuplicates(t *testing.T) {
+	m := blocksMetainfo(1, 2)
+	c := client{pieces: bitfield.New(1), transferred: &transferStats{}}
+	s := newSwarm(c, m, 2, 0, newChoker(2, 0), newBanList(time.Minute, 3))
+	peers := []*peerConn{newTestPeer(0), newTestPeer(1)}
+	for _, p := range peers {
+		p.blocks = make(chan pwp.Message, 4)
+		p.changed = make(chan struct{}, 1)
+		p.dl.requests = map[blockKey]bool{}
+		p.dl.reqq = 250
+		s.picker.addPeer(p, bitfield.NewFull(1))
+	}
+	defer func() {
+		for _, p := range peers {
+			close(p.closed)
+		}
+	}()
+	expect := func(p *peerConn, typ pwp.MessageType, k blockKey) {
+		t.Helper()
+		select {
+		case msg := <-p.out:
+			if msg.Typ != typ || msg.PieceIndex != k.index || msg.BlockOffset != k.offset {
+				t.Fatalf("got %s for %d/%d, expected %s for %d/%d", msg.Typ, msg.PieceIndex, msg.BlockOffset, typ, k.index, k.offset)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s for %d/%d", typ, k.index, k.offset)
+		}
+	}
+
+	// The first peer requests all blocks, so the second one requests the
+	// same ones in endgame mode
+	k0, k1 := blockKey{0, 0}, blockKey{0, blockLength}
+	go s.download(peers[0])
+	expect(peers[0], pwp.MessageRequest, k0)
+	expect(peers[0], pwp.MessageRequest, k1)
+	go s.download(peers[1])
+	expect(peers[1], pwp.MessageRequest, k0)
+	expect(peers[1], pwp.MessageRequest, k1)
+
+	peers[1].blocks <- pwp.Message{Typ: pwp.MessagePiece, PieceIndex: 0, BlockOffset: 0, Data: make([]byte, blockLength)}
+	expect(peers[0], pwp.MessageCancel, k0)
+}
@@ -1,11 +1,9 @@
 package main
 
 import (
-	"crypto/sha1"
-	"fmt"
 	"time"
 
-	"github.com/pieterkockx/bittorrent/pwp"
+	"github.com/pieterkockx/bittorrent/bitfield"
 )
 
 const (
@@ -18,34 +16,16 @@ type piece struct {
 	data  []byte
 }
 
-func fetchPiece(out chan pwp.Message, index, pieceLength uint32, hash [20]byte) (piece, error) {
-	data := make([]byte, 0)
-	for offs := uint32(0); offs < pieceLength; offs += blockLength {
-		l := blockLength
-		if offs+blockLength > pieceLength {
-			l = pieceLength - offs
+// pieceSize returns the length of piece index; the last piece might be
+// shorter than the others
+func (m metainfo) pieceSize(index uint32) uint32 {
+	if int64(index) == int64(len(m.pieceHashes))-1 {
+		r := m.totalSize % int64(m.pieceLength)
+		if r != 0 {
+			return uint32(r)
 		}
-
-		in := make(chan pwp.Message)
-		msg := pwp.Message{Typ: pwp.MessagePiece, PieceIndex: index, BlockOffset: offs}
-		expect(in, msg)
-
-		out <- pwp.Message{pwp.MessageRequest, index, offs, l, []byte{}}
-
-		inmsg := pwp.Message{}
-		select {
-		case inmsg = <-in:
-		case <-time.After(pieceTimeout):
-			unforward(msg)
-			return piece{}, fmt.Errorf("timed out after %s", pieceTimeout)
-		}
-
-		data = append(data, inmsg.Data...)
-	}
-	if sha1.Sum(data) != hash {
-		return piece{}, fmt.Errorf("hash differs")
 	}
-	return piece{index, data}, nil
+	return m.pieceLength
 }
 
 func storePiece(p piece, pieceLength uint32, f *fileList) error {
@@ -74,14 +54,11 @@ func storePiece(p piece, pieceLength uint32, f *fileList) error {
 	return nil
 }
 
-func getPiece(from chan pwp.Message, index uint32, length uint32, m metainfo) error {
-	p, err := fetchPiece(from, index, length, m.pieceHashes[index])
-	if err != nil {
-		return fmt.Errorf("fetching piece: %s", err)
+// left returns the number of bytes in the pieces not yet set
+func (m metainfo) left(pieces *bitfield.Bitfield) int64 {
+	n := int64(0)
+	for _, i := range pieces.Missing() {
+		n += int64(m.pieceSize(uint32(i)))
 	}
-	err = storePiece(p, m.pieceLength, m.firstFile)
-	if err != nil {
-		return fmt.Errorf("storing piece: %s", err)
-	}
-	return nil
+	return n
 }
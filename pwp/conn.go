@@ -0,0 +1,184 @@
+package pwp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Size of the read and write buffers of a Conn, which holds a few blocks of
+// the usual size
+const bufferSize = 1 << 16
+
+// BlockSize is the usual length of a block. Decoders take buffers of this
+// size for the data of piece messages from a pool
+const BlockSize = 1 << 14
+
+// The pool holds array pointers, which unlike slices go into an interface
+// without allocating
+var blockPool = sync.Pool{
+	New: func() interface{} {
+		return new([BlockSize]byte)
+	},
+}
+
+// getBlock returns a buffer of length n, from the pool if it fits
+func getBlock(n int) []byte {
+	if n > BlockSize {
+		return make([]byte, n)
+	}
+	b := blockPool.Get().(*[BlockSize]byte)
+	return b[:n]
+}
+
+// Release returns the data of a piece message read by a Decoder to the pool.
+// The data must not be used afterwards
+func Release(msg Message) {
+	if msg.Typ != MessagePiece || cap(msg.Data) != BlockSize {
+		return
+	}
+	blockPool.Put((*[BlockSize]byte)(msg.Data[:BlockSize]))
+}
+
+// BlockSource reads blocks of pieces from storage
+type BlockSource interface {
+	ReadBlock(index, begin uint32, p []byte) error
+}
+
+// Encoder writes messages to a buffered writer without allocating. Nothing
+// reaches the underlying writer before Flush or a full buffer
+type Encoder struct {
+	w   *bufio.Writer
+	src BlockSource
+	hdr [maxHeaderLength]byte
+}
+
+func NewEncoder(w io.Writer, src BlockSource) *Encoder {
+	return &Encoder{w: bufio.NewWriterSize(w, bufferSize), src: src}
+}
+
+func (e *Encoder) Encode(msg Message) error {
+	n := msg.putHeader(e.hdr[:])
+	_, err := e.w.Write(e.hdr[:n])
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(msg.payload())
+	return err
+}
+
+// EncodeBlock writes a piece message with the block of length bytes at begin
+// in piece index, which is read from storage straight into the write buffer.
+// If reading fails, nothing is written
+func (e *Encoder) EncodeBlock(index, begin, length uint32) error {
+	msg := Message{Typ: MessagePiece, PieceIndex: index, BlockOffset: begin}
+	n := 13 + int(length)
+	if e.w.Available() < n && e.w.Buffered() > 0 {
+		if err := e.w.Flush(); err != nil {
+			return err
+		}
+	}
+	var b []byte
+	if e.w.Available() >= n {
+		b = e.w.AvailableBuffer()[:n]
+	} else {
+		b = make([]byte, n)
+	}
+	msg.putHeader(e.hdr[:])
+	copy(b, e.hdr[:13])
+	binary.BigEndian.PutUint32(b[:4], uint32(n-4))
+	if err := e.src.ReadBlock(index, begin, b[13:]); err != nil {
+		return fmt.Errorf("reading piece %d (offset %d, length %d): %s", index, begin, length, err)
+	}
+	_, err := e.w.Write(b)
+	return err
+}
+
+func (e *Encoder) Flush() error {
+	return e.w.Flush()
+}
+
+// Decoder reads messages from a buffered reader. The data of piece messages
+// is taken from a pool and should be handed back with Release; the data of
+// other messages is only valid until the next call to Decode
+type Decoder struct {
+	r      *bufio.Reader
+	limits Limits
+	hdr    [maxHeaderLength]byte
+	buf    []byte
+}
+
+func NewDecoder(r io.Reader, l Limits) *Decoder {
+	return &Decoder{r: bufio.NewReaderSize(r, bufferSize), limits: l}
+}
+
+// Decode reads a message that is no longer than the limits allow for its
+// type. The body is only read once its length checks out
+func (d *Decoder) Decode() (Message, error) {
+	n, err := io.ReadFull(d.r, d.hdr[:4])
+	if err != nil {
+		return Message{}, fmt.Errorf("reading message length (read %d [of %d] bytes): %s", n, 4, err)
+	}
+	u := binary.BigEndian.Uint32(d.hdr[:4])
+	if u == 0 {
+		return Message{Typ: MessageKeepAlive}, nil
+	}
+	t, err := d.r.ReadByte()
+	if err != nil {
+		return Message{}, fmt.Errorf("reading message type: %s", err)
+	}
+	typ := MessageType(t)
+	max := d.limits.MaxLength(typ)
+	if max == 0 {
+		return Message{}, fmt.Errorf("message has unknown type (%d)", int(typ))
+	}
+	if u > max {
+		return Message{}, fmt.Errorf("%s message length %d bytes longer than maximum length %d bytes", typ, u, max)
+	}
+
+	if typ == MessagePiece {
+		if u < 9 {
+			return Message{}, fmt.Errorf("%s message has wrong length (got %d bytes, expected at least 9 bytes)", typ, u)
+		}
+		n, err = io.ReadFull(d.r, d.hdr[:8])
+		if err != nil {
+			return Message{}, fmt.Errorf("reading message body (read %d [of %d] bytes): %s", n, u-1, err)
+		}
+		msg := Message{Typ: typ}
+		msg.PieceIndex = binary.BigEndian.Uint32(d.hdr[0:4])
+		msg.BlockOffset = binary.BigEndian.Uint32(d.hdr[4:8])
+		msg.Data = getBlock(int(u - 9))
+		n, err = io.ReadFull(d.r, msg.Data)
+		if err != nil {
+			Release(msg)
+			return Message{}, fmt.Errorf("reading message body (read %d [of %d] bytes): %s", 8+n, u-1, err)
+		}
+		return msg, nil
+	}
+
+	if uint32(cap(d.buf)) < u {
+		d.buf = make([]byte, u)
+	}
+	b := d.buf[:u]
+	b[0] = t
+	n, err = io.ReadFull(d.r, b[1:])
+	if err != nil {
+		return Message{}, fmt.Errorf("reading message body (read %d [of %d] bytes): %s", n, u-1, err)
+	}
+	return unmarshalMessage(b)
+}
+
+// Conn is a peer wire connection with buffered reading and writing. Reading
+// and writing may happen concurrently, but not two reads or two writes
+type Conn struct {
+	net.Conn
+	*Encoder
+	*Decoder
+}
+
+func NewConn(c net.Conn, l Limits, src BlockSource) *Conn {
+	return &Conn{c, NewEncoder(c, src), NewDecoder(c, l)}
+}
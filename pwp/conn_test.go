@@ -0,0 +1,193 @@
+package pwp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// Number of piece messages of BlockSize in a megabyte
+const blocksPerMB = (1 << 20) / BlockSize
+
+var testLimits = Limits{Pieces: 64, MaxBlock: BlockSize, MaxExtended: 1 << 10}
+
+// memSource serves blocks from a single piece held in memory
+type memSource []byte
+
+func (s memSource) ReadBlock(index, begin uint32, p []byte) error {
+	copy(p, s[begin:])
+	return nil
+}
+
+// repeatReader reads b over and over
+type repeatReader struct {
+	b   []byte
+	off int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.b[r.off:])
+	r.off = (r.off + n) % len(r.b)
+	return n, nil
+}
+
+func testPiece() memSource {
+	b := make([]byte, blocksPerMB*BlockSize)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func TestEncodeDecode(t *testing.T) {
+	src := testPiece()
+	msgs := []Message{
+		{Typ: MessageKeepAlive},
+		{Typ: MessageUnchoke},
+		{Typ: MessageHave, PieceIndex: 3},
+		{Typ: MessageRequest, PieceIndex: 1, BlockOffset: BlockSize, BlockLength: BlockSize},
+		{Typ: MessageBitfield, Data: []byte{0xff, 0x00, 0x80, 0x01, 0, 0, 0, 0x80}},
+		{Typ: MessagePiece, PieceIndex: 2, BlockOffset: 0, Data: src[:BlockSize]},
+		{Typ: MessageExtended, ExtendedID: 1, Data: []byte("d1:ai1ee")},
+	}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, src)
+	for _, msg := range msgs {
+		if err := e.Encode(msg); err != nil {
+			t.Fatalf("encoding %s: %s", msg.Typ, err)
+		}
+	}
+	if err := e.EncodeBlock(5, BlockSize, 100); err != nil {
+		t.Fatalf("encoding block: %s", err)
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatalf("flushing: %s", err)
+	}
+	msgs = append(msgs, Message{Typ: MessagePiece, PieceIndex: 5, BlockOffset: BlockSize, Data: src[BlockSize : BlockSize+100]})
+
+	d := NewDecoder(&buf, testLimits)
+	for _, expected := range msgs {
+		msg, err := d.Decode()
+		if err != nil {
+			t.Fatalf("decoding %s: %s", expected.Typ, err)
+		}
+		if msg.Typ != expected.Typ || msg.PieceIndex != expected.PieceIndex || msg.BlockOffset != expected.BlockOffset ||
+			msg.BlockLength != expected.BlockLength || msg.ExtendedID != expected.ExtendedID || !bytes.Equal(msg.Data, expected.Data) {
+			t.Errorf("got %+v, expected %+v", msg, expected)
+		}
+		Release(msg)
+	}
+	if _, err := d.Decode(); err == nil {
+		t.Errorf("decoding past the end succeeded")
+	}
+}
+
+func TestDecodeTooLong(t *testing.T) {
+	b := make([]byte, 5)
+	binary.BigEndian.PutUint32(b, 9+BlockSize+1)
+	b[4] = byte(MessagePiece)
+	d := NewDecoder(io.MultiReader(bytes.NewReader(b), &repeatReader{b: []byte{0}}), testLimits)
+	if _, err := d.Decode(); err == nil {
+		t.Errorf("decoding a piece message longer than the limit succeeded")
+	}
+}
+
+// The benchmarks below move a megabyte of piece messages per iteration
+
+func BenchmarkMarshal(b *testing.B) {
+	src := testPiece()
+	b.SetBytes(1 << 20)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < blocksPerMB; j++ {
+			msg := Message{Typ: MessagePiece, PieceIndex: 0, BlockOffset: uint32(j * BlockSize), Data: src[j*BlockSize : (j+1)*BlockSize]}
+			io.Discard.Write(msg.Marshal())
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	src := testPiece()
+	e := NewEncoder(io.Discard, src)
+	b.SetBytes(1 << 20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < blocksPerMB; j++ {
+			msg := Message{Typ: MessagePiece, PieceIndex: 0, BlockOffset: uint32(j * BlockSize), Data: src[j*BlockSize : (j+1)*BlockSize]}
+			if err := e.Encode(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+		e.Flush()
+	}
+}
+
+func BenchmarkEncodeBlock(b *testing.B) {
+	e := NewEncoder(io.Discard, testPiece())
+	b.SetBytes(1 << 20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < blocksPerMB; j++ {
+			if err := e.EncodeBlock(0, uint32(j*BlockSize), BlockSize); err != nil {
+				b.Fatal(err)
+			}
+		}
+		e.Flush()
+	}
+}
+
+// encodedPiece returns a megabyte of piece messages as sent on the wire
+func encodedPiece(b *testing.B) []byte {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, testPiece())
+	for j := 0; j < blocksPerMB; j++ {
+		if err := e.EncodeBlock(0, uint32(j*BlockSize), BlockSize); err != nil {
+			b.Fatal(err)
+		}
+	}
+	e.Flush()
+	return buf.Bytes()
+}
+
+// BenchmarkUnmarshal reads messages into a new buffer each, as Decode did
+// before it took piece data from a pool
+func BenchmarkUnmarshal(b *testing.B) {
+	r := &repeatReader{b: encodedPiece(b)}
+	var hdr [4]byte
+	b.SetBytes(1 << 20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < blocksPerMB; j++ {
+			if _, err := io.ReadFull(r, hdr[:]); err != nil {
+				b.Fatal(err)
+			}
+			buf := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+			if _, err := io.ReadFull(r, buf); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := unmarshalMessage(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	d := NewDecoder(&repeatReader{b: encodedPiece(b)}, testLimits)
+	b.SetBytes(1 << 20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < blocksPerMB; j++ {
+			msg, err := d.Decode()
+			if err != nil {
+				b.Fatal(err)
+			}
+			Release(msg)
+		}
+	}
+}
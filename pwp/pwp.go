@@ -6,8 +6,6 @@ import (
 	"io"
 )
 
-const maxMessageLength = uint32(1 << 15)
-
 type MessageType byte
 
 const (
@@ -22,6 +20,26 @@ const (
 	MessageCancel
 )
 
+// MessageKeepAlive stands for the message of length zero, which has no type
+// on the wire
+const MessageKeepAlive MessageType = 0xff
+
+// BEP 6 fast extension
+const (
+	MessageSuggest MessageType = iota + 13
+	MessageHaveAll
+	MessageHaveNone
+	MessageRejectRequest
+	MessageAllowedFast
+)
+
+// BEP 10 extension protocol
+const (
+	MessageExtended MessageType = 20
+
+	ExtendedHandshakeID = uint8(0)
+)
+
 var messageTypeToString = map[MessageType]string{
 	MessageChoke:         "choke",
 	MessageUnchoke:       "unchoke",
@@ -32,6 +50,13 @@ var messageTypeToString = map[MessageType]string{
 	MessageRequest:       "request",
 	MessagePiece:         "piece",
 	MessageCancel:        "cancel",
+	MessageSuggest:       "suggest piece",
+	MessageHaveAll:       "have all",
+	MessageHaveNone:      "have none",
+	MessageRejectRequest: "reject request",
+	MessageAllowedFast:   "allowed fast",
+	MessageExtended:      "extended",
+	MessageKeepAlive:     "keep-alive",
 }
 
 func (t MessageType) String() string {
@@ -42,40 +67,73 @@ func (t MessageType) String() string {
 }
 
 type Handshake struct {
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
+// The extension protocol is signalled by the 20th bit from the right of the
+// reserved bytes
+func (h Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&0x10 != 0
+}
+
+func (h *Handshake) SetExtensions() {
+	h.Reserved[5] |= 0x10
+}
+
+// The fast extension is signalled by the third bit from the right
+func (h Handshake) SupportsFast() bool {
+	return h.Reserved[7]&0x04 != 0
+}
+
+func (h *Handshake) SetFast() {
+	h.Reserved[7] |= 0x04
+}
+
 type Message struct {
 	Typ         MessageType
 	PieceIndex  uint32
 	BlockOffset uint32
 	BlockLength uint32
-	Data        []byte
+	// ExtendedID is the extended message ID of extended messages, whose
+	// payload is in Data
+	ExtendedID uint8
+	Data       []byte
 }
 
 func (h Handshake) Marshal() []byte {
 	b := make([]byte, 68)
 	b[0] = 19
 	copy(b[1:20], []byte("BitTorrent protocol"))
-	// Leave next 8 bytes set to zero
+	copy(b[20:28], h.Reserved[:])
 	copy(b[28:48], h.InfoHash[:])
 	copy(b[48:68], h.PeerID[:])
 	return b
 }
 
-func (msg Message) Id() string {
-	m := Message{}
-	m.Typ = msg.Typ
-	m.PieceIndex = msg.PieceIndex
-	m.BlockOffset = msg.BlockOffset
-	m.BlockLength = msg.BlockLength
-	return string(m.Marshal())
+// Length of the longest part of a message that precedes its data, which is
+// that of a request
+const maxHeaderLength = 17
+
+// payload returns the data that follows the header of msg, if its type has
+// any
+func (msg Message) payload() []byte {
+	switch msg.Typ {
+	case MessageBitfield, MessagePiece, MessageExtended:
+		return msg.Data
+	}
+	return nil
 }
 
-func (msg Message) Marshal() []byte {
-	b := make([]byte, 5)
-	length := 1
+// putHeader writes the part of msg that precedes its payload to b, which
+// must hold maxHeaderLength bytes, and returns its length
+func (msg Message) putHeader(b []byte) int {
+	if msg.Typ == MessageKeepAlive {
+		binary.BigEndian.PutUint32(b[:4], 0)
+		return 4
+	}
+	n := 5
 	switch msg.Typ {
 	case MessageChoke:
 		fallthrough
@@ -84,37 +142,55 @@ func (msg Message) Marshal() []byte {
 	case MessageInterested:
 		fallthrough
 	case MessageNotInterested:
+		fallthrough
+	case MessageHaveAll:
+		fallthrough
+	case MessageHaveNone:
+		fallthrough
+	case MessageBitfield:
 		/* break */
 	case MessageHave:
-		b = append(b, make([]byte, 4)...)
+		fallthrough
+	case MessageSuggest:
+		fallthrough
+	case MessageAllowedFast:
 		binary.BigEndian.PutUint32(b[5:9], msg.PieceIndex)
-		length += 4
+		n += 4
 	case MessageRequest:
 		fallthrough
 	case MessageCancel:
-		b = append(b, make([]byte, 12)...)
+		fallthrough
+	case MessageRejectRequest:
 		binary.BigEndian.PutUint32(b[5:9], msg.PieceIndex)
 		binary.BigEndian.PutUint32(b[9:13], msg.BlockOffset)
 		binary.BigEndian.PutUint32(b[13:17], msg.BlockLength)
-		length += 12
-	case MessageBitfield:
-		b = append(b, msg.Data...)
-		length += len(msg.Data)
+		n += 12
 	case MessagePiece:
-		b = append(b, make([]byte, 8)...)
 		binary.BigEndian.PutUint32(b[5:9], msg.PieceIndex)
 		binary.BigEndian.PutUint32(b[9:13], msg.BlockOffset)
-		length += 8
-		b = append(b, msg.Data...)
-		length += len(msg.Data)
+		n += 8
+	case MessageExtended:
+		b[5] = msg.ExtendedID
+		n++
 	default:
 		panic(fmt.Sprintf("marshaling message: message has unknown type (%d)", int(msg.Typ)))
 	}
-	b[4] = byte(msg.Typ)
+	length := n - 4 + len(msg.payload())
 	if int64(length) != int64(uint32(length)) {
 		panic(fmt.Sprintf("marshaling message: length=%d overflows integer", length))
 	}
 	binary.BigEndian.PutUint32(b[:4], uint32(length))
+	b[4] = byte(msg.Typ)
+	return n
+}
+
+func (msg Message) Marshal() []byte {
+	var h [maxHeaderLength]byte
+	n := msg.putHeader(h[:])
+	p := msg.payload()
+	b := make([]byte, n+len(p))
+	copy(b, h[:n])
+	copy(b[n:], p)
 	return b
 }
 
@@ -122,15 +198,16 @@ func unmarshalHandshake(b []byte) (Handshake, error) {
 	if b[0] != 19 || string(b[1:20]) != "BitTorrent protocol" {
 		return Handshake{}, fmt.Errorf("unknown protocol")
 	}
-	// Ignore next 8 bytes
 	h := Handshake{}
+	copy(h.Reserved[:], b[20:28])
+	copy(h.InfoHash[:], b[28:48])
 	copy(h.PeerID[:], b[48:68])
 	return h, nil
 }
 
 func unmarshalMessage(b []byte) (Message, error) {
 	if len(b) == 0 {
-		return Message{}, fmt.Errorf("message has length 0")
+		return Message{Typ: MessageKeepAlive}, nil
 	}
 	typ := MessageType(b[0])
 	msg := Message{Typ: typ}
@@ -142,11 +219,19 @@ func unmarshalMessage(b []byte) (Message, error) {
 	case MessageInterested:
 		fallthrough
 	case MessageNotInterested:
+		fallthrough
+	case MessageHaveAll:
+		fallthrough
+	case MessageHaveNone:
 		if len(b) != 1 {
 			return Message{}, fmt.Errorf("%s message has wrong length (got %d bytes, expected 1 bytes)", typ, len(b))
 		}
 		break
 	case MessageHave:
+		fallthrough
+	case MessageSuggest:
+		fallthrough
+	case MessageAllowedFast:
 		if len(b) != 5 {
 			return Message{}, fmt.Errorf("%s message has wrong length (got %d bytes, expected 5 bytes)", typ, len(b))
 		}
@@ -154,6 +239,8 @@ func unmarshalMessage(b []byte) (Message, error) {
 	case MessageRequest:
 		fallthrough
 	case MessageCancel:
+		fallthrough
+	case MessageRejectRequest:
 		if len(b) != 13 {
 			return Message{}, fmt.Errorf("%s message has wrong length (got %d bytes, expected 13 bytes)", typ, len(b))
 		}
@@ -170,28 +257,45 @@ func unmarshalMessage(b []byte) (Message, error) {
 		msg.PieceIndex = binary.BigEndian.Uint32(b[1:5])
 		msg.BlockOffset = binary.BigEndian.Uint32(b[5:9])
 		msg.Data = b[9:]
+	case MessageExtended:
+		if len(b) < 2 {
+			return Message{}, fmt.Errorf("%s message has wrong length (got %d bytes, expected at least 2 bytes)", typ, len(b))
+		}
+		msg.ExtendedID = b[1]
+		msg.Data = b[2:]
 	default:
 		return Message{}, fmt.Errorf("message has unknown type (%d)", int(typ))
 	}
 	return msg, nil
 }
 
-func ReadMessage(rr io.Reader) (Message, error) {
-	var l [4]byte
-	n, err := io.ReadFull(rr, l[:])
-	if err != nil {
-		return Message{}, fmt.Errorf("reading message length (read %d [of %d] bytes): %s", n, len(l), err)
-	}
-	u := binary.BigEndian.Uint32(l[:])
-	if u > maxMessageLength {
-		return Message{}, fmt.Errorf("message length %d bytes longer than maximum length %d bytes", u, maxMessageLength)
-	}
-	buf := make([]byte, u)
-	n, err = io.ReadFull(rr, buf)
-	if err != nil {
-		return Message{}, fmt.Errorf("reading message body (read %d [of %d] bytes): %s", n, len(buf), err)
+// Limits bounds the length of the messages read from a connection. Most
+// message types have a fixed length; the others are bounded by the number of
+// pieces of the torrent and the largest block or extended message accepted
+type Limits struct {
+	Pieces      int
+	MaxBlock    uint32
+	MaxExtended uint32
+}
+
+// MaxLength returns the largest length of a message of type typ, including
+// the type, or 0 if messages of type typ are not accepted at all
+func (l Limits) MaxLength(typ MessageType) uint32 {
+	switch typ {
+	case MessageChoke, MessageUnchoke, MessageInterested, MessageNotInterested, MessageHaveAll, MessageHaveNone:
+		return 1
+	case MessageHave, MessageSuggest, MessageAllowedFast:
+		return 5
+	case MessageRequest, MessageCancel, MessageRejectRequest:
+		return 13
+	case MessageBitfield:
+		return 1 + uint32((l.Pieces+7)/8)
+	case MessagePiece:
+		return 9 + l.MaxBlock
+	case MessageExtended:
+		return 2 + l.MaxExtended
 	}
-	return unmarshalMessage(buf)
+	return 0
 }
 
 func ReadHandshake(rr io.Reader) (Handshake, error) {
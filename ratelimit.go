@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// byteRate is a transfer rate in bytes per second; 0 means unlimited. As a
+// flag it accepts a k, M or G suffix (powers of 1024)
+type byteRate int64
+
+func (r byteRate) String() string {
+	return strconv.FormatInt(int64(r), 10)
+}
+
+func (r *byteRate) Set(s string) error {
+	v := s
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid rate %q", v)
+	}
+	*r = byteRate(n * mult)
+	return nil
+}
+
+// rateLimits are the configured limits on the upload and download rate of
+// the whole process, of the torrent and of every single peer
+type rateLimits struct {
+	up, down               byteRate
+	torrentUp, torrentDown byteRate
+	peerUp, peerDown       byteRate
+}
+
+func (l *rateLimits) registerFlags(flags *flag.FlagSet) {
+	flags.Var(&l.up, "up-rate", "maximum upload rate in bytes per second (0 for unlimited)")
+	flags.Var(&l.down, "down-rate", "maximum download rate in bytes per second (0 for unlimited)")
+	flags.Var(&l.torrentUp, "torrent-up-rate", "maximum upload rate of the torrent in bytes per second")
+	flags.Var(&l.torrentDown, "torrent-down-rate", "maximum download rate of the torrent in bytes per second")
+	flags.Var(&l.peerUp, "peer-up-rate", "maximum upload rate to a single peer in bytes per second")
+	flags.Var(&l.peerDown, "peer-down-rate", "maximum download rate from a single peer in bytes per second")
+}
+
+// readRateLimits reads limits from a file with one flag per line, without
+// the dash (e.g. "up-rate=512k"). Limits that are not in the file keep the
+// values in l
+func readRateLimits(path string, l rateLimits) (rateLimits, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return rateLimits{}, err
+	}
+	defer f.Close()
+	args := make([]string, 0)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args = append(args, "-"+line)
+	}
+	if err := sc.Err(); err != nil {
+		return rateLimits{}, err
+	}
+	flags := flag.NewFlagSet(path, flag.ContinueOnError)
+	flags.SetOutput(new(strings.Builder))
+	l.registerFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return rateLimits{}, err
+	}
+	return l, nil
+}
+
+// reloadRateLimits rereads the rate limits from path whenever the process
+// receives SIGHUP. Limits that are not in the file are taken from defaults
+func reloadRateLimits(s *swarm, path string, defaults rateLimits) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		l, err := readRateLimits(path, defaults)
+		if err != nil {
+			log.Printf("rate limits: reading %s: %s: keeping current limits\n", path, err)
+			continue
+		}
+		log.Printf("rate limits: reloaded %s\n", path)
+		s.setLimits(l)
+	}
+}
+
+// rateLimiter is a token bucket that allows bursts of one second worth of
+// bytes. Transfers may take more tokens than there are, after which the next
+// transfer waits until the debt is paid off
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   byteRate
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate byteRate) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// setRate changes the rate, also for transfers that are in progress
+func (l *rateLimiter) setRate(rate byteRate) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = rate
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+}
+
+// refill must be called with l.mu held
+func (l *rateLimiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+}
+
+// take takes n tokens and returns how long to wait before transferring them
+func (l *rateLimiter) take(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// bandwidth limits the upload and download rate of something
+type bandwidth struct {
+	up, down *rateLimiter
+}
+
+func newBandwidth(up, down byteRate) bandwidth {
+	return bandwidth{newRateLimiter(up), newRateLimiter(down)}
+}
+
+// globalBandwidth is shared by all torrents
+var globalBandwidth = newBandwidth(0, 0)
+
+// limiters is a chain of rate limiters that all apply to a transfer
+type limiters []*rateLimiter
+
+// delay takes n tokens from all limiters and returns how long to wait before
+// transferring n bytes
+func (ls limiters) delay(n int) time.Duration {
+	d := time.Duration(0)
+	for _, l := range ls {
+		if w := l.take(n); w > d {
+			d = w
+		}
+	}
+	return d
+}
+
+// wait blocks until n bytes may be transferred according to all limiters
+func (ls limiters) wait(n int) {
+	if d := ls.delay(n); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pieterkockx/bittorrent/bencode"
+)
+
+const (
+	udpProtocolID     = uint64(0x41727101980)
+	udpTrackerTimeout = 5 * time.Second
+	udpTrackerRetries = 3
+	// Trackers that have not answered the scrape by then are ranked as if
+	// it failed, so that they do not hold up the first announce
+	rankTimeout = 3 * time.Second
+)
+
+const (
+	udpActionConnect = uint32(iota)
+	udpActionAnnounce
+	udpActionScrape
+	udpActionError
+)
+
+type scrapeResult struct {
+	seeders   int64
+	leechers  int64
+	completed int64
+}
+
+func (r scrapeResult) String() string {
+	return fmt.Sprintf("seeders: %d, leechers: %d, completed: %d", r.seeders, r.leechers, r.completed)
+}
+
+// makeScrapeURL derives the scrape URL from an announce URL following the
+// convention that the last path component "announce" is replaced by "scrape"
+func makeScrapeURL(infoHash [20]byte, host string) (*url.URL, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("parsing URL: %s", err)
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if i == -1 || !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return nil, fmt.Errorf("tracker does not support scrape (announce URL path %q)", u.Path)
+	}
+	u.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(u.Path[i+1:], "announce")
+
+	q := u.Query()
+	q.Set("info_hash", string(infoHash[:]))
+	u.RawQuery = strings.Replace(q.Encode(), "+", "%20", -1)
+
+	return u, nil
+}
+
+func (tc *trackerClient) scrapeHTTP(infoHash [20]byte, host string) (scrapeResult, error) {
+	u, err := makeScrapeURL(infoHash, host)
+	if err != nil {
+		return scrapeResult{}, fmt.Errorf("scrape URL: %s", err)
+	}
+	b, err := tc.get(u)
+	if err != nil {
+		return scrapeResult{}, err
+	}
+	d, err := bencode.UnmarshalDict(b)
+	if err != nil {
+		return scrapeResult{}, fmt.Errorf("unmarshaling scrape response: %s", err)
+	}
+	return parseScrapeResponse(d, infoHash)
+}
+
+func parseScrapeResponse(d1 map[string]interface{}, infoHash [20]byte) (scrapeResult, error) {
+	s, b := d1["failure reason"].(string)
+	if b {
+		return scrapeResult{}, fmt.Errorf("tracker returned failure response: %q", s)
+	}
+	files, b := d1["files"].(map[string]interface{})
+	if !b {
+		return scrapeResult{}, fmt.Errorf("scrape response contains no files entry of type dictionary")
+	}
+	d2, b := files[string(infoHash[:])].(map[string]interface{})
+	if !b {
+		return scrapeResult{}, fmt.Errorf("scrape response contains no dictionary entry for info hash")
+	}
+	r := scrapeResult{}
+	if r.seeders, b = d2["complete"].(int64); !b {
+		return scrapeResult{}, fmt.Errorf("scrape response entry contains no complete entry of type integer")
+	}
+	if r.leechers, b = d2["incomplete"].(int64); !b {
+		return scrapeResult{}, fmt.Errorf("scrape response entry contains no incomplete entry of type integer")
+	}
+	if r.completed, b = d2["downloaded"].(int64); !b {
+		return scrapeResult{}, fmt.Errorf("scrape response entry contains no downloaded entry of type integer")
+	}
+	return r, nil
+}
+
+// udpRoundTrip sends req and waits for a response to the same action and
+// transaction ID (BEP 15), retrying on timeout
+func udpRoundTrip(conn net.Conn, req []byte, action, tid uint32) ([]byte, error) {
+	buf := make([]byte, 2048)
+	for n := 0; n < udpTrackerRetries; n++ {
+		conn.SetWriteDeadline(time.Now().Add(udpTrackerTimeout))
+		_, err := conn.Write(req)
+		if err != nil {
+			return []byte{}, fmt.Errorf("writing request: %s", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(udpTrackerTimeout << uint(n)))
+		for {
+			m, err := conn.Read(buf)
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					break
+				}
+				return []byte{}, fmt.Errorf("reading response: %s", err)
+			}
+			if m < 8 || binary.BigEndian.Uint32(buf[4:8]) != tid {
+				continue
+			}
+			a := binary.BigEndian.Uint32(buf[0:4])
+			if a == udpActionError {
+				return []byte{}, fmt.Errorf("tracker returned error response: %q", buf[8:m])
+			}
+			if a != action {
+				return []byte{}, fmt.Errorf("tracker returned response to action %d, expected action %d", a, action)
+			}
+			return buf[:m], nil
+		}
+	}
+	return []byte{}, fmt.Errorf("timed out after %d attempts", udpTrackerRetries)
+}
+
+func udpConnect(conn net.Conn) (uint64, error) {
+	tid := rand.Uint32()
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+	binary.BigEndian.PutUint32(req[12:16], tid)
+	resp, err := udpRoundTrip(conn, req, udpActionConnect, tid)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) < 16 {
+		return 0, fmt.Errorf("connect response has wrong length (got %d bytes, expected 16 bytes)", len(resp))
+	}
+	return binary.BigEndian.Uint64(resp[8:16]), nil
+}
+
+func scrapeUDP(infoHash [20]byte, host string) (scrapeResult, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return scrapeResult{}, fmt.Errorf("parsing URL: %s", err)
+	}
+	conn, err := net.DialTimeout("udp", u.Host, udpTrackerTimeout)
+	if err != nil {
+		return scrapeResult{}, fmt.Errorf("dialing tracker: %s", err)
+	}
+	defer conn.Close()
+
+	connID, err := udpConnect(conn)
+	if err != nil {
+		return scrapeResult{}, fmt.Errorf("connecting: %s", err)
+	}
+
+	tid := rand.Uint32()
+	req := make([]byte, 36)
+	binary.BigEndian.PutUint64(req[0:8], connID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionScrape)
+	binary.BigEndian.PutUint32(req[12:16], tid)
+	copy(req[16:36], infoHash[:])
+	resp, err := udpRoundTrip(conn, req, udpActionScrape, tid)
+	if err != nil {
+		return scrapeResult{}, fmt.Errorf("scraping: %s", err)
+	}
+	if len(resp) < 20 {
+		return scrapeResult{}, fmt.Errorf("scrape response has wrong length (got %d bytes, expected 20 bytes)", len(resp))
+	}
+	return scrapeResult{
+		seeders:   int64(binary.BigEndian.Uint32(resp[8:12])),
+		completed: int64(binary.BigEndian.Uint32(resp[12:16])),
+		leechers:  int64(binary.BigEndian.Uint32(resp[16:20])),
+	}, nil
+}
+
+func (tc *trackerClient) scrape(infoHash [20]byte, host string) (scrapeResult, error) {
+	switch {
+	case strings.HasPrefix(host, "http://"), strings.HasPrefix(host, "https://"):
+		return tc.scrapeHTTP(infoHash, host)
+	case strings.HasPrefix(host, "udp://"):
+		return scrapeUDP(infoHash, host)
+	}
+	return scrapeResult{}, fmt.Errorf("unsupported tracker URL scheme in %q", host)
+}
+
+type trackerScrape struct {
+	host   string
+	result scrapeResult
+	err    error
+}
+
+// scrapeAll scrapes all trackers concurrently, returning the results in
+// the same order as hosts. Scrapes still running at the deadline are given up
+// on; a zero deadline waits for all of them
+func (tc *trackerClient) scrapeAll(infoHash [20]byte, hosts []string, deadline time.Time) []trackerScrape {
+	type indexedScrape struct {
+		i int
+		trackerScrape
+	}
+	results := make(chan indexedScrape, len(hosts))
+	for i := 0; i < len(hosts); i++ {
+		go func(i int) {
+			r, err := tc.scrape(infoHash, hosts[i])
+			results <- indexedScrape{i, trackerScrape{hosts[i], r, err}}
+		}(i)
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	scrapes := make([]trackerScrape, len(hosts))
+	for i := 0; i < len(hosts); i++ {
+		scrapes[i] = trackerScrape{host: hosts[i], err: errors.New("timed out")}
+	}
+	for n := 0; n < len(hosts); n++ {
+		select {
+		case r := <-results:
+			scrapes[r.i] = r.trackerScrape
+		case <-timeout:
+			return scrapes
+		}
+	}
+	return scrapes
+}
+
+// rank orders trackers by the number of peers they report, most
+// seeders first; trackers that could not be scraped keep their relative order
+// after the ones that could
+func (tc *trackerClient) rank(infoHash [20]byte, hosts []string) []string {
+	scrapes := tc.scrapeAll(infoHash, hosts, time.Now().Add(rankTimeout))
+	sort.SliceStable(scrapes, func(i, j int) bool {
+		a, b := scrapes[i], scrapes[j]
+		if a.err != nil || b.err != nil {
+			return a.err == nil && b.err != nil
+		}
+		if a.result.seeders != b.result.seeders {
+			return a.result.seeders > b.result.seeders
+		}
+		return a.result.leechers > b.result.leechers
+	})
+	ranked := make([]string, len(scrapes))
+	for i := 0; i < len(scrapes); i++ {
+		if scrapes[i].err != nil {
+			log.Printf("tracker ranking: scraping %s: %s\n", scrapes[i].host, scrapes[i].err)
+		} else {
+			log.Printf("tracker ranking: %s: %s\n", scrapes[i].host, scrapes[i].result)
+		}
+		ranked[i] = scrapes[i].host
+	}
+	return ranked
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pieterkockx/bittorrent/mse"
+	"github.com/pieterkockx/bittorrent/pwp"
+	"github.com/pieterkockx/bittorrent/utp"
+)
+
+const (
+	defaultMaxPeers = 50
+	// Addresses that could not be connected to are not retried for a while
+	peerRetryInterval = 5 * time.Minute
+	// Addresses that wait for a free slot, beyond which the oldest ones are
+	// dropped
+	maxPendingAddrs = 200
+)
+
+type swarm struct {
+	c        client
+	m        metainfo
+	maxPeers int
+	// requestQueue is the number of outstanding block requests per peer, or
+	// 0 to adapt it to the download rate
+	requestQueue int
+	// haveSuppression skips have messages to peers that have the piece
+	haveSuppression bool
+	// encryption decides which peer connections use Message Stream
+	// Encryption
+	encryption mse.Policy
+	// transport decides whether peers are dialed over TCP or uTP, which
+	// goes through utp
+	transport transportPolicy
+	utp       *utp.Socket
+
+	addrs chan string
+	done  chan struct{}
+
+	picker *picker
+	choker *choker
+	bans   *banList
+	bw     bandwidth
+
+	// slots limits the number of simultaneous connections (and connection
+	// attempts); freed is signalled when one is given back
+	slots chan struct{}
+	freed chan struct{}
+
+	mu sync.Mutex
+	// peers holds the connected peers, dialing the addresses we dialed
+	// (until that connection ends) and ids the connection kept for every
+	// peer ID
+	peers   map[string]*peerConn
+	dialing map[string]bool
+	ids     map[[20]byte]*peerConn
+	failed  map[string]time.Time
+	limits  rateLimits
+}
+
+func newSwarm(c client, m metainfo, maxPeers, requestQueue int, ch *choker, bl *banList) *swarm {
+	if maxPeers <= 0 {
+		maxPeers = 1
+	}
+	done := make(chan struct{})
+	return &swarm{
+		c:            c,
+		m:            m,
+		maxPeers:     maxPeers,
+		requestQueue: requestQueue,
+		picker:       newPicker(m, c.pieces, done),
+		choker:       ch,
+		bans:         bl,
+		bw:           newBandwidth(0, 0),
+		addrs:        make(chan string),
+		done:         done,
+		slots:        make(chan struct{}, maxPeers),
+		freed:        make(chan struct{}, 1),
+		peers:        map[string]*peerConn{},
+		dialing:      map[string]bool{},
+		ids:          map[[20]byte]*peerConn{},
+		failed:       map[string]time.Time{},
+	}
+}
+
+// run connects to addresses from s.addrs while there are free slots, so that
+// connections that are dropped get replaced by new ones. Addresses keep being
+// taken from s.addrs when all slots are in use, so that trackers and local
+// discovery never wait on us. It keeps going after the download is done so
+// that we can seed
+func (s *swarm) run() {
+	log.Printf("swarm: started (max %d peers)\n", s.maxPeers)
+	pending := make([]string, 0)
+	for {
+		select {
+		case addr := <-s.addrs:
+			if len(pending) == maxPendingAddrs {
+				pending = pending[1:]
+			}
+			pending = append(pending, addr)
+		case <-s.freed:
+		}
+		pending = s.dialPending(pending)
+	}
+}
+
+// dialPending connects to pending addresses for as long as there are free
+// slots, and returns the addresses left waiting
+func (s *swarm) dialPending(pending []string) []string {
+	for len(pending) > 0 {
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			return pending
+		}
+		addr := pending[0]
+		pending = pending[1:]
+		if !s.reserve(addr) {
+			<-s.slots
+			continue
+		}
+		go s.connect(addr)
+	}
+	return pending
+}
+
+// reserve marks addr as dialed, unless it is already connected or dialed,
+// failed recently or is banned
+func (s *swarm) reserve(addr string) bool {
+	if s.bans.isBanned(addr) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dialing[addr] || s.peers[addr] != nil {
+		return false
+	}
+	if t, has := s.failed[addr]; has && time.Since(t) < peerRetryInterval {
+		return false
+	}
+	s.dialing[addr] = true
+	return true
+}
+
+// release gives back the slot of a connection to addr, which we dialed if
+// outbound is set
+func (s *swarm) release(addr string, outbound, failed bool) {
+	s.mu.Lock()
+	if outbound {
+		delete(s.dialing, addr)
+	}
+	if failed {
+		s.failed[addr] = time.Now()
+	}
+	n := len(s.peers)
+	s.mu.Unlock()
+	<-s.slots
+	select {
+	case s.freed <- struct{}{}:
+	default:
+	}
+	log.Printf("swarm: %d peers\n", n)
+}
+
+func (s *swarm) connect(addr string) {
+	peer, err := s.addPeer(addr)
+	if err != nil {
+		log.Printf("swarm: adding peer: %s\n", err)
+		s.release(addr, true, true)
+		return
+	}
+	log.Printf("swarm: succesfully connected to %s\n", addr)
+	s.serve(peer, true)
+}
+
+// listen accepts inbound connections and hands them to the same peer
+// management as outbound ones, as long as there are free slots
+func (s *swarm) listen(l net.Listener) {
+	log.Printf("swarm: listening on %s\n", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Printf("swarm: no longer listening on %s\n", l.Addr())
+				return
+			}
+			log.Printf("swarm: accepting connection: %s\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		// A peer that we are dialing or failed to dial may still get
+		// through this way; serve settles duplicates by peer ID
+		addr := conn.RemoteAddr().String()
+		if s.bans.isBanned(addr) {
+			log.Printf("swarm: rejecting connection from %s: banned\n", addr)
+			conn.Close()
+			continue
+		}
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			log.Printf("swarm: rejecting connection from %s: too many peers\n", addr)
+			conn.Close()
+			continue
+		}
+		go s.accept(conn)
+	}
+}
+
+func (s *swarm) accept(conn net.Conn) {
+	addr := conn.RemoteAddr().String()
+	peer, err := s.acceptPeer(conn)
+	if err != nil {
+		log.Printf("swarm: accepting peer: %s\n", err)
+		s.release(addr, false, false)
+		return
+	}
+	log.Printf("swarm: accepted connection from %s\n", addr)
+	s.serve(peer, false)
+}
+
+// serve runs a connection until it closes, unless there already is a
+// connection to the same peer ID. When both sides dial each other at once,
+// both keep the connection dialed by the peer with the lower peer ID
+func (s *swarm) serve(peer *peerConn, outbound bool) {
+	addr := peer.info.addr
+	id := peer.info.peerID
+
+	// Started before anything else so that receive never blocks on requests
+	go upload(s.c, s.m, peer, s.choker)
+
+	s.mu.Lock()
+	if old := s.ids[id]; old != nil {
+		if !s.dialedByLower(peer, old) {
+			s.mu.Unlock()
+			log.Printf("swarm: already connected to peer ID %q: closing %s\n", id[:], addr)
+			peer.close()
+			<-peer.closed
+			s.release(addr, outbound, false)
+			return
+		}
+		log.Printf("swarm: already connected to peer ID %q: closing %s in favour of %s\n", id[:], old.info.addr, addr)
+		old.close()
+	}
+	s.peers[addr] = peer
+	s.ids[id] = peer
+	s.mu.Unlock()
+
+	s.download(peer)
+	<-peer.closed
+	log.Printf("swarm: connection to %s was closed\n", addr)
+
+	s.mu.Lock()
+	if s.ids[id] == peer {
+		delete(s.ids, id)
+	}
+	if s.peers[addr] == peer {
+		delete(s.peers, addr)
+	}
+	s.mu.Unlock()
+	s.release(addr, outbound, false)
+}
+
+// dialedByLower reports whether p was dialed by a peer with a lower peer ID
+// than old. Must be called with s.mu held
+func (s *swarm) dialedByLower(p, old *peerConn) bool {
+	dialer := func(p *peerConn) []byte {
+		if p.info.outbound {
+			return s.c.peerID[:]
+		}
+		return p.info.peerID[:]
+	}
+	return bytes.Compare(dialer(p), dialer(old)) < 0
+}
+
+// seeding reports whether all pieces are set
+func (s *swarm) seeding() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// connected returns the peers we completed the handshake with
+func (s *swarm) connected() []*peerConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make([]*peerConn, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// announce tells the connected peers that we now have piece index, and
+// withdraws our interest in peers that have nothing left for us
+func (s *swarm) announce(index uint32) {
+	for _, p := range s.connected() {
+		if !s.haveSuppression || !p.info.pieces.Has(int(index)) {
+			if !p.send(pwp.Message{Typ: pwp.MessageHave, PieceIndex: index}) {
+				continue
+			}
+		}
+		p.updateInterest()
+	}
+}
+
+// setLimits applies rate limits, also to the peers already connected
+func (s *swarm) setLimits(l rateLimits) {
+	globalBandwidth.up.setRate(l.up)
+	globalBandwidth.down.setRate(l.down)
+	s.bw.up.setRate(l.torrentUp)
+	s.bw.down.setRate(l.torrentDown)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = l
+	for _, p := range s.peers {
+		p.bw.up.setRate(l.peerUp)
+		p.bw.down.setRate(l.peerDown)
+	}
+}
+
+// disconnect closes the connections to peers at ip
+func (s *swarm) disconnect(ip string) {
+	for _, p := range s.connected() {
+		if hostOf(p.info.addr) == ip {
+			log.Printf("swarm: closing banned peer %s\n", p.info.addr)
+			p.close()
+		}
+	}
+}
+
+// choke runs the choker every rechoke interval, or earlier when asked to
+func (s *swarm) choke() {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			peers := s.connected()
+			s.choker.sample(peers, now)
+			s.choker.rechoke(peers, s.seeding(), now)
+		case <-s.choker.kick:
+			s.choker.rechoke(s.connected(), s.seeding(), time.Now())
+		}
+	}
+}
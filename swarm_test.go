@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pieterkockx/bittorrent/bitfield"
+)
+
+func TestRunTakesAddrsWhenFull(t *testing.T) {
+	c := client{pieces: bitfield.New(4), transferred: &transferStats{}}
+	s := newSwarm(c, testMetainfo(), 1, 0, newChoker(1, 0), newBanList(time.Minute, 3))
+	// The only slot is taken, so nothing gets dialed
+	s.slots <- struct{}{}
+	go s.run()
+
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*maxPendingAddrs; i++ {
+			s.addrs <- fmt.Sprintf("192.0.2.1:%d", 1000+i)
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("sending addresses blocked while all slots were in use")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.dialing) != 0 {
+		t.Errorf("dialed %d addresses without a free slot", len(s.dialing))
+	}
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"compress/gzip"
 	"encoding/binary"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func makeTrackerURL(c client, m metainfo, host string) (*url.URL, error) {
+// makeTrackerURL returns the announce URL for host. The event is left out if
+// it is empty
+func makeTrackerURL(c client, m metainfo, host, event string) (*url.URL, error) {
 	u, err := url.Parse(host)
 	if err != nil {
 		return nil, fmt.Errorf("parsing URL: %s", err)
@@ -23,10 +31,18 @@ func makeTrackerURL(c client, m metainfo, host string) (*url.URL, error) {
 	q2 := u.Query()
 	q2.Set("peer_id", string(c.peerID[:]))
 	q2.Set("port", c.port)
-	q2.Set("uploaded", "0")
-	q2.Set("downloaded", "0")
-	q2.Set("left", fmt.Sprintf("%d", m.totalSize))
+	q2.Set("uploaded", strconv.FormatInt(c.transferred.uploaded.Load(), 10))
+	q2.Set("downloaded", strconv.FormatInt(c.transferred.downloaded.Load(), 10))
+	q2.Set("left", fmt.Sprintf("%d", m.left(c.pieces)))
 	q2.Set("compact", "1")
+	if event != "" {
+		q2.Set("event", event)
+	}
+	if c.ipv6 != "" {
+		// BEP 7: let the tracker know our IPv6 address, whichever
+		// address family the announce goes over
+		q2.Set("ipv6", c.ipv6)
+	}
 
 	// Some stupid trackers don't accept "+" instead of "%20"
 	s1 := strings.Replace(q1.Encode(), "+", "%20", 1)
@@ -38,25 +54,135 @@ func makeTrackerURL(c client, m metainfo, host string) (*url.URL, error) {
 	return u, nil
 }
 
-func announceToTracker(c client, m metainfo, h string) ([]byte, error) {
-	u, err := makeTrackerURL(c, m, h)
+const (
+	defaultTrackerTimeout     = 15 * time.Second
+	defaultTrackerMaxBodySize = int64(1 << 20)
+)
+
+type trackerClientConfig struct {
+	timeout     time.Duration
+	userAgent   string
+	proxy       string
+	maxBodySize int64
+	// httpClient, if set, is used instead of a client built from timeout
+	// and proxy, such as the client of an httptest server
+	httpClient *http.Client
+}
+
+func (cfg *trackerClientConfig) registerFlags(flags *flag.FlagSet) {
+	flags.DurationVar(&cfg.timeout, "tracker-timeout", defaultTrackerTimeout, "timeout of tracker requests")
+	flags.StringVar(&cfg.userAgent, "user-agent", "bittorrent/"+version, "user agent sent to HTTP trackers")
+	flags.StringVar(&cfg.proxy, "proxy", "", "proxy URL for HTTP tracker requests (default from environment)")
+	flags.Int64Var(&cfg.maxBodySize, "tracker-max-body", defaultTrackerMaxBodySize, "maximum size in bytes of tracker responses")
+}
+
+type trackerClient struct {
+	http        *http.Client
+	userAgent   string
+	maxBodySize int64
+}
+
+func newTrackerClient(cfg trackerClientConfig) (*trackerClient, error) {
+	if cfg.httpClient != nil {
+		return &trackerClient{
+			http:        cfg.httpClient,
+			userAgent:   cfg.userAgent,
+			maxBodySize: cfg.maxBodySize,
+		}, nil
+	}
+	proxy := http.ProxyFromEnvironment
+	if cfg.proxy != "" {
+		u, err := url.Parse(cfg.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("parsing proxy URL: %s", err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           (&net.Dialer{Timeout: cfg.timeout}).DialContext,
+		TLSHandshakeTimeout:   cfg.timeout,
+		ResponseHeaderTimeout: cfg.timeout,
+		// Compression is handled in get so that the body size limit
+		// applies to the decompressed response
+		DisableCompression: true,
+	}
+	return &trackerClient{
+		http:        &http.Client{Transport: transport, Timeout: cfg.timeout},
+		userAgent:   cfg.userAgent,
+		maxBodySize: cfg.maxBodySize,
+	}, nil
+}
+
+func (tc *trackerClient) get(u *url.URL) ([]byte, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
-		return []byte{}, fmt.Errorf("tracker URL: %s", err)
+		return []byte{}, fmt.Errorf("creating request: %s", err)
 	}
-	resp, err := http.Get(u.String())
+	if tc.userAgent != "" {
+		req.Header.Set("User-Agent", tc.userAgent)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := tc.http.Do(req)
 	if err != nil {
 		return []byte{}, fmt.Errorf("HTTP GET request to tracker: %s", err)
 	}
-	b, err := ioutil.ReadAll(resp.Body)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return []byte{}, fmt.Errorf("tracker returned HTTP status %q", resp.Status)
+	}
+
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		z, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return []byte{}, fmt.Errorf("reading gzip header of tracker response: %s", err)
+		}
+		defer z.Close()
+		body = z
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, tc.maxBodySize+1))
 	if err != nil {
 		return []byte{}, fmt.Errorf("reading tracker response: %s", err)
 	}
+	if int64(len(b)) > tc.maxBodySize {
+		return []byte{}, fmt.Errorf("tracker response longer than maximum length %d bytes", tc.maxBodySize)
+	}
 	return b, nil
 }
 
+// canAnnounce reports whether announce supports the scheme of host
+func canAnnounce(host string) bool {
+	return strings.HasPrefix(host, "http://") || strings.HasPrefix(host, "https://")
+}
+
+func (tc *trackerClient) announce(c client, m metainfo, h, event string) ([]byte, error) {
+	u, err := makeTrackerURL(c, m, h, event)
+	if err != nil {
+		return []byte{}, fmt.Errorf("tracker URL: %s", err)
+	}
+	return tc.get(u)
+}
+
+func parseCompactPeers(s string, size int) ([]string, error) {
+	if len(s)%size != 0 {
+		return []string{}, fmt.Errorf("compact peers string not divisible by %d", size)
+	}
+	peers := make([]string, 0, len(s)/size)
+	for i := 0; i < len(s); i += size {
+		ip := net.IP([]byte(s[i : i+size-2]))
+		port := binary.BigEndian.Uint16([]byte(s[i+size-2 : i+size]))
+		peers = append(peers, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}
+	return peers, nil
+}
+
 func parseTrackerResponse(d1 map[string]interface{}) ([]string, error) {
 	var s string
-	var b1, b2 bool
+	var b1, b2, b3 bool
 	var l []interface{}
 	var d2 map[string]interface{}
 	var i int64
@@ -70,19 +196,18 @@ func parseTrackerResponse(d1 map[string]interface{}) ([]string, error) {
 
 	s, b1 = d1["peers"].(string)
 	l, b2 = d1["peers"].([]interface{})
-	if !b1 && !b2 {
-		return []string{}, fmt.Errorf("tracker response contains no peers entry of type string and no peers entry of type list")
+	s6, b3 := d1["peers6"].(string)
+	if !b1 && !b2 && !b3 {
+		return []string{}, fmt.Errorf("tracker response contains no peers entry of type string or list and no peers6 entry of type string")
 	}
 
 	if b1 {
-		if len(s)%6 != 0 {
-			return []string{}, fmt.Errorf("tracker response contains peers string not divisible by 6")
+		p, err := parseCompactPeers(s, 6)
+		if err != nil {
+			return []string{}, fmt.Errorf("tracker response contains invalid peers string: %s", err)
 		}
-		for i := 0; i < len(s); i += 6 {
-			peer := fmt.Sprintf("%d.%d.%d.%d:%d", s[i], s[i+1], s[i+2], s[i+3], binary.BigEndian.Uint16([]byte(s[i+4:i+6])))
-			peers = append(peers, peer)
-		}
-	} else {
+		peers = append(peers, p...)
+	} else if b2 {
 		for j := 0; j < len(l); j++ {
 			d2, b1 = l[j].(map[string]interface{})
 			if !b1 {
@@ -96,10 +221,19 @@ func parseTrackerResponse(d1 map[string]interface{}) ([]string, error) {
 			if !b1 {
 				return []string{}, fmt.Errorf("tracker response contains peers list with a dictionary entry that contains no port entry of type integer")
 			}
-			peer := fmt.Sprintf("%s:%d", s, i)
+			// The ip entry may be an IPv4 or IPv6 literal or a DNS name
+			peer := net.JoinHostPort(s, strconv.FormatInt(i, 10))
 			peers = append(peers, peer)
 		}
 	}
 
+	if b3 {
+		p, err := parseCompactPeers(s6, 18)
+		if err != nil {
+			return []string{}, fmt.Errorf("tracker response contains invalid peers6 string: %s", err)
+		}
+		peers = append(peers, p...)
+	}
+
 	return peers, nil
 }
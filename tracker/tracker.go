@@ -0,0 +1,375 @@
+// Package tracker implements an HTTP BitTorrent tracker that keeps its state
+// in memory. A Server is an http.Handler, so it can be run on its own or
+// mounted in an httptest.Server.
+package tracker
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pieterkockx/bittorrent/bencode"
+)
+
+const (
+	DefaultInterval    = 30 * time.Minute
+	DefaultMinInterval = 5 * time.Minute
+	DefaultNumWant     = 50
+	MaxNumWant         = 200
+)
+
+type Config struct {
+	// Interval and MinInterval are sent to clients in announce responses
+	Interval    time.Duration
+	MinInterval time.Duration
+	// PeerExpiry is how long a peer is kept without announcing again;
+	// defaults to twice Interval
+	PeerExpiry time.Duration
+	// Allowlist restricts the tracker to the given info hashes; nil allows
+	// every info hash
+	Allowlist [][20]byte
+	// TrustIP lets clients choose their address with the ip parameter
+	// instead of using the address the request came from
+	TrustIP bool
+}
+
+type peer struct {
+	id       [20]byte
+	ip       net.IP
+	ip6      net.IP
+	port     int
+	left     int64
+	lastSeen time.Time
+}
+
+type swarm struct {
+	peers      map[string]*peer
+	downloaded int64
+}
+
+type Server struct {
+	cfg   Config
+	allow map[[20]byte]bool
+	now   func() time.Time
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*swarm
+}
+
+func New(cfg Config) *Server {
+	if cfg.Interval == 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.MinInterval == 0 || cfg.MinInterval > cfg.Interval {
+		cfg.MinInterval = cfg.Interval
+		if DefaultMinInterval < cfg.Interval {
+			cfg.MinInterval = DefaultMinInterval
+		}
+	}
+	if cfg.PeerExpiry == 0 {
+		cfg.PeerExpiry = 2 * cfg.Interval
+	}
+	s := &Server{cfg: cfg, now: time.Now, torrents: map[[20]byte]*swarm{}}
+	if cfg.Allowlist != nil {
+		s.allow = map[[20]byte]bool{}
+		for _, h := range cfg.Allowlist {
+			s.allow[h] = true
+		}
+	}
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var d map[string]interface{}
+	var err error
+	switch r.URL.Path {
+	case "/announce":
+		d, err = s.announce(r)
+	case "/scrape":
+		d, err = s.scrape(r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		d = map[string]interface{}{"failure reason": err.Error()}
+	}
+	b, err := bencode.Marshal(d)
+	if err != nil {
+		log.Printf("tracker: marshaling response: %s\n", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(b)
+}
+
+func (s *Server) allowed(h [20]byte) bool {
+	return s.allow == nil || s.allow[h]
+}
+
+// expire removes peers that have not announced within the expiry time and
+// must be called with s.mu held
+func (s *Server) expire(t *swarm) {
+	deadline := s.now().Add(-s.cfg.PeerExpiry)
+	for k, p := range t.peers {
+		if p.lastSeen.Before(deadline) {
+			delete(t.peers, k)
+		}
+	}
+}
+
+func (t *swarm) counts() (complete, incomplete int64) {
+	for _, p := range t.peers {
+		if p.left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+	return
+}
+
+func parseHash(s string) ([20]byte, error) {
+	var h [20]byte
+	if len(s) != 20 {
+		return h, fmt.Errorf("info_hash has wrong length (got %d bytes, expected 20 bytes)", len(s))
+	}
+	copy(h[:], s)
+	return h, nil
+}
+
+func parseInt(q map[string][]string, key string, required bool) (int64, error) {
+	v, has := q[key]
+	if !has || len(v) == 0 {
+		if required {
+			return 0, fmt.Errorf("missing %s", key)
+		}
+		return 0, nil
+	}
+	i, err := strconv.ParseInt(v[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s", key)
+	}
+	return i, nil
+}
+
+func (s *Server) remoteIP(r *http.Request, q map[string][]string) (net.IP, net.IP) {
+	var ip, ip6 net.IP
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err == nil {
+		ip = net.ParseIP(host)
+	}
+	if s.cfg.TrustIP {
+		if v := q["ip"]; len(v) > 0 && net.ParseIP(v[0]) != nil {
+			ip = net.ParseIP(v[0])
+		}
+	}
+	// BEP 7: a client announcing over IPv4 may tell us its IPv6 address
+	if v := q["ipv6"]; len(v) > 0 {
+		if a := net.ParseIP(v[0]); a != nil && a.To4() == nil {
+			ip6 = a
+		}
+	}
+	// ip only holds IPv4 addresses; an IPv6 one stands in for a missing
+	// ipv6 parameter
+	if ip != nil && ip.To4() == nil {
+		if ip6 == nil {
+			ip6 = ip
+		}
+		ip = nil
+	}
+	return ip, ip6
+}
+
+func (s *Server) announce(r *http.Request) (map[string]interface{}, error) {
+	q := r.URL.Query()
+
+	h, err := parseHash(q.Get("info_hash"))
+	if err != nil {
+		return nil, err
+	}
+	if !s.allowed(h) {
+		return nil, fmt.Errorf("unregistered torrent")
+	}
+	id := q.Get("peer_id")
+	if len(id) != 20 {
+		return nil, fmt.Errorf("peer_id has wrong length (got %d bytes, expected 20 bytes)", len(id))
+	}
+	port, err := parseInt(q, "port", true)
+	if err != nil {
+		return nil, err
+	}
+	if port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port")
+	}
+	left, err := parseInt(q, "left", true)
+	if err != nil {
+		return nil, err
+	}
+	numWant, err := parseInt(q, "numwant", false)
+	if err != nil {
+		return nil, err
+	}
+	// A missing numwant parses as 0
+	if numWant <= 0 {
+		numWant = DefaultNumWant
+	}
+	if numWant > MaxNumWant {
+		numWant = MaxNumWant
+	}
+	ip, ip6 := s.remoteIP(r, q)
+	if ip == nil && ip6 == nil {
+		return nil, fmt.Errorf("cannot determine peer address")
+	}
+	event := q.Get("event")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, has := s.torrents[h]
+	if !has {
+		t = &swarm{peers: map[string]*peer{}}
+		s.torrents[h] = t
+	}
+	s.expire(t)
+
+	// Peers are keyed by peer ID so that a client keeps a single entry
+	// regardless of how many address families it announces with
+	if event == "stopped" {
+		delete(t.peers, id)
+	} else {
+		p, has := t.peers[id]
+		if !has {
+			p = &peer{}
+			copy(p.id[:], id)
+			t.peers[id] = p
+		}
+		if event == "completed" && p.left != 0 {
+			t.downloaded++
+		}
+		p.ip, p.ip6, p.port, p.left, p.lastSeen = ip, ip6, int(port), left, s.now()
+	}
+
+	complete, incomplete := t.counts()
+	d := map[string]interface{}{
+		"interval":     int64(s.cfg.Interval / time.Second),
+		"min interval": int64(s.cfg.MinInterval / time.Second),
+		"complete":     complete,
+		"incomplete":   incomplete,
+	}
+
+	selected := s.selectPeers(t, id, left == 0, int(numWant))
+	if q.Get("compact") == "1" {
+		peers := make([]byte, 0, 6*len(selected))
+		peers6 := make([]byte, 0)
+		for _, p := range selected {
+			port := []byte{byte(p.port >> 8), byte(p.port)}
+			if ip4 := p.ip.To4(); ip4 != nil {
+				peers = append(append(peers, ip4...), port...)
+			}
+			if p.ip6 != nil {
+				peers6 = append(append(peers6, p.ip6.To16()...), port...)
+			}
+		}
+		d["peers"] = peers
+		if len(peers6) > 0 {
+			d["peers6"] = peers6
+		}
+	} else {
+		noPeerID := q.Get("no_peer_id") == "1"
+		peers := make([]interface{}, 0, len(selected))
+		for _, p := range selected {
+			ip := p.ip
+			if ip == nil {
+				ip = p.ip6
+			}
+			e := map[string]interface{}{"ip": ip.String(), "port": int64(p.port)}
+			if !noPeerID {
+				e["peer id"] = p.id[:]
+			}
+			peers = append(peers, e)
+		}
+		d["peers"] = peers
+	}
+
+	return d, nil
+}
+
+// selectPeers returns up to n random peers other than the requesting one;
+// seeders are not sent to seeders. Must be called with s.mu held
+func (s *Server) selectPeers(t *swarm, self string, seeding bool, n int) []*peer {
+	peers := make([]*peer, 0, len(t.peers))
+	for k, p := range t.peers {
+		if k == self || (seeding && p.left == 0) {
+			continue
+		}
+		peers = append(peers, p)
+	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+func (s *Server) scrape(r *http.Request) (map[string]interface{}, error) {
+	q := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hashes := make([][20]byte, 0)
+	if v, has := q["info_hash"]; has {
+		for _, e := range v {
+			h, err := parseHash(e)
+			if err != nil {
+				return nil, err
+			}
+			hashes = append(hashes, h)
+		}
+	} else {
+		for h := range s.torrents {
+			hashes = append(hashes, h)
+		}
+	}
+
+	files := map[string]interface{}{}
+	for _, h := range hashes {
+		if !s.allowed(h) {
+			continue
+		}
+		var complete, incomplete, downloaded int64
+		if t, has := s.torrents[h]; has {
+			s.expire(t)
+			complete, incomplete = t.counts()
+			downloaded = t.downloaded
+		}
+		files[string(h[:])] = map[string]interface{}{
+			"complete":   complete,
+			"incomplete": incomplete,
+			"downloaded": downloaded,
+		}
+	}
+	return map[string]interface{}{"files": files}, nil
+}
+
+// ParseInfoHash parses a hex encoded info hash, as used in allowlist files
+func ParseInfoHash(s string) ([20]byte, error) {
+	var h [20]byte
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return h, fmt.Errorf("decoding %q: %s", s, err)
+	}
+	if len(b) != 20 {
+		return h, fmt.Errorf("info hash %q has wrong length (got %d bytes, expected 20 bytes)", s, len(b))
+	}
+	copy(h[:], b)
+	return h, nil
+}
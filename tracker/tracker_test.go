@@ -0,0 +1,246 @@
+package tracker
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pieterkockx/bittorrent/bencode"
+)
+
+var testHash = [20]byte{0xaa}
+
+func request(t *testing.T, s *Server, remoteAddr, path string, q url.Values) map[string]interface{} {
+	t.Helper()
+	r := httptest.NewRequest("GET", path+"?"+q.Encode(), nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got HTTP status %d, expected %d", w.Code, http.StatusOK)
+	}
+	d, err := bencode.UnmarshalDict(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("unmarshaling response %q: %s", w.Body.Bytes(), err)
+	}
+	return d
+}
+
+func announceQuery(id byte, port int, left int64) url.Values {
+	peerID := fmt.Sprintf("-TT0001-%012d", id)
+	return url.Values{
+		"info_hash": {string(testHash[:])},
+		"peer_id":   {peerID},
+		"port":      {fmt.Sprint(port)},
+		"left":      {fmt.Sprint(left)},
+		"compact":   {"1"},
+	}
+}
+
+func announce(t *testing.T, s *Server, remoteAddr string, q url.Values) map[string]interface{} {
+	t.Helper()
+	d := request(t, s, remoteAddr, "/announce", q)
+	if f, has := d["failure reason"]; has {
+		t.Fatalf("announce failed: %s", f)
+	}
+	return d
+}
+
+func scrapeCounts(t *testing.T, s *Server) (complete, incomplete, downloaded int64) {
+	t.Helper()
+	d := request(t, s, "127.0.0.1:1", "/scrape", url.Values{"info_hash": {string(testHash[:])}})
+	files, _ := d["files"].(map[string]interface{})
+	f, b := files[string(testHash[:])].(map[string]interface{})
+	if !b {
+		t.Fatalf("scrape response %v has no entry for info hash", d)
+	}
+	return f["complete"].(int64), f["incomplete"].(int64), f["downloaded"].(int64)
+}
+
+func TestAnnounceCompact(t *testing.T) {
+	s := New(Config{Interval: time.Minute, MinInterval: 30 * time.Second})
+	announce(t, s, "10.0.0.1:5000", announceQuery(1, 6881, 0))
+	// A client connecting over IPv6 that also sends ipv6 must not end up
+	// in the IPv4 list
+	q := announceQuery(2, 6882, 100)
+	q.Set("ipv6", "2001:db8::2")
+	announce(t, s, "[2001:db8::1]:5000", q)
+	d := announce(t, s, "10.0.0.3:5000", announceQuery(3, 6883, 100))
+
+	if d["interval"] != int64(60) || d["min interval"] != int64(30) {
+		t.Errorf("got interval %v and min interval %v, expected 60 and 30", d["interval"], d["min interval"])
+	}
+	if d["complete"] != int64(1) || d["incomplete"] != int64(2) {
+		t.Errorf("got complete %v and incomplete %v, expected 1 and 2", d["complete"], d["incomplete"])
+	}
+	peers, _ := d["peers"].(string)
+	if peers != "\x0a\x00\x00\x01\x1a\xe1" {
+		t.Errorf("got peers %q, expected only 10.0.0.1:6881", peers)
+	}
+	peers6, _ := d["peers6"].(string)
+	if len(peers6) != 18 || peers6[:2] != "\x20\x01" || peers6[16:] != "\x1a\xe2" {
+		t.Errorf("got peers6 %q, expected only [2001:db8::2]:6882", peers6)
+	}
+}
+
+func TestAnnounceDictionary(t *testing.T) {
+	s := New(Config{})
+	announce(t, s, "10.0.0.1:5000", announceQuery(1, 6881, 0))
+	q := announceQuery(2, 6882, 100)
+	q.Del("compact")
+	d := announce(t, s, "10.0.0.2:5000", q)
+
+	peers, _ := d["peers"].([]interface{})
+	if len(peers) != 1 {
+		t.Fatalf("got %d peers, expected 1", len(peers))
+	}
+	p, _ := peers[0].(map[string]interface{})
+	if p["ip"] != "10.0.0.1" || p["port"] != int64(6881) || p["peer id"] != fmt.Sprintf("-TT0001-%012d", 1) {
+		t.Errorf("got peer %v, expected 10.0.0.1:6881 with its peer id", p)
+	}
+
+	q.Set("no_peer_id", "1")
+	d = announce(t, s, "10.0.0.2:5000", q)
+	peers, _ = d["peers"].([]interface{})
+	if _, has := peers[0].(map[string]interface{})["peer id"]; has {
+		t.Errorf("got peer id despite no_peer_id")
+	}
+}
+
+func TestSeedersNotSentToSeeders(t *testing.T) {
+	s := New(Config{})
+	announce(t, s, "10.0.0.1:5000", announceQuery(1, 6881, 0))
+	d := announce(t, s, "10.0.0.2:5000", announceQuery(2, 6882, 0))
+	if peers, _ := d["peers"].(string); peers != "" {
+		t.Errorf("got peers %q for a seeder, expected none", peers)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s := New(Config{})
+	announce(t, s, "10.0.0.1:5000", announceQuery(1, 6881, 100))
+	q := announceQuery(1, 6881, 0)
+	q.Set("event", "completed")
+	announce(t, s, "10.0.0.1:5000", q)
+	// Announcing completion twice counts once
+	announce(t, s, "10.0.0.1:5000", q)
+	if complete, incomplete, downloaded := scrapeCounts(t, s); complete != 1 || incomplete != 0 || downloaded != 1 {
+		t.Errorf("got %d complete, %d incomplete, %d downloaded, expected 1, 0 and 1", complete, incomplete, downloaded)
+	}
+
+	q.Set("event", "stopped")
+	announce(t, s, "10.0.0.1:5000", q)
+	if complete, incomplete, _ := scrapeCounts(t, s); complete != 0 || incomplete != 0 {
+		t.Errorf("got %d complete and %d incomplete after stopped, expected none", complete, incomplete)
+	}
+}
+
+func TestPeerExpiry(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	s := New(Config{Interval: time.Minute})
+	s.now = func() time.Time { return now }
+	announce(t, s, "10.0.0.1:5000", announceQuery(1, 6881, 100))
+
+	now = now.Add(2*time.Minute - time.Second)
+	if _, incomplete, _ := scrapeCounts(t, s); incomplete != 1 {
+		t.Errorf("peer expired before twice the interval")
+	}
+	now = now.Add(2 * time.Second)
+	if _, incomplete, _ := scrapeCounts(t, s); incomplete != 0 {
+		t.Errorf("peer not expired after twice the interval")
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	s := New(Config{Allowlist: [][20]byte{{0xbb}}})
+	d := request(t, s, "10.0.0.1:5000", "/announce", announceQuery(1, 6881, 100))
+	if _, has := d["failure reason"]; !has {
+		t.Errorf("announce for an info hash not in the allowlist succeeded")
+	}
+	d = request(t, s, "10.0.0.1:5000", "/scrape", url.Values{"info_hash": {string(testHash[:])}})
+	if files, _ := d["files"].(map[string]interface{}); len(files) != 0 {
+		t.Errorf("got scrape entries %v for an info hash not in the allowlist", files)
+	}
+
+	q := announceQuery(1, 6881, 100)
+	q.Set("info_hash", string([]byte{0xbb, 19: 0}))
+	announce(t, s, "10.0.0.1:5000", q)
+}
+
+func TestInvalidAnnounce(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		value string
+	}{
+		{"short info hash", "info_hash", "abc"},
+		{"short peer id", "peer_id", "abc"},
+		{"no port", "port", ""},
+		{"port out of range", "port", "70000"},
+		{"bad left", "left", "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := announceQuery(1, 6881, 100)
+			if tt.value == "" {
+				q.Del(tt.key)
+			} else {
+				q.Set(tt.key, tt.value)
+			}
+			d := request(t, New(Config{}), "10.0.0.1:5000", "/announce", q)
+			if _, has := d["failure reason"]; !has {
+				t.Errorf("got %v, expected a failure reason", d)
+			}
+		})
+	}
+}
+
+func TestTrustIP(t *testing.T) {
+	for _, trust := range []bool{false, true} {
+		s := New(Config{TrustIP: trust})
+		q := announceQuery(1, 6881, 100)
+		q.Set("ip", "10.9.9.9")
+		announce(t, s, "10.0.0.1:5000", q)
+		q = announceQuery(2, 6882, 100)
+		q.Del("compact")
+		d := announce(t, s, "10.0.0.2:5000", q)
+		peers, _ := d["peers"].([]interface{})
+		expected := "10.0.0.1"
+		if trust {
+			expected = "10.9.9.9"
+		}
+		if ip := peers[0].(map[string]interface{})["ip"]; ip != expected {
+			t.Errorf("with TrustIP %t got ip %v, expected %s", trust, ip, expected)
+		}
+	}
+}
+
+func TestNumWant(t *testing.T) {
+	s := New(Config{})
+	for i := 1; i <= 5; i++ {
+		announce(t, s, fmt.Sprintf("10.0.0.%d:5000", i), announceQuery(byte(i), 6880+i, 100))
+	}
+	tests := []struct {
+		numWant  string
+		expected int
+	}{
+		{"", 5},
+		{"2", 2},
+		{"0", 5},
+		{"-1", 5},
+		{"1000", 5},
+	}
+	for _, tt := range tests {
+		q := announceQuery(0, 6880, 100)
+		if tt.numWant != "" {
+			q.Set("numwant", tt.numWant)
+		}
+		d := announce(t, s, "10.0.0.9:5000", q)
+		if peers, _ := d["peers"].(string); len(peers) != 6*tt.expected {
+			t.Errorf("numwant %q: got %d peers, expected %d", tt.numWant, len(peers)/6, tt.expected)
+		}
+	}
+}
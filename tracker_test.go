@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pieterkockx/bittorrent/bencode"
+	"github.com/pieterkockx/bittorrent/bitfield"
+	"github.com/pieterkockx/bittorrent/tracker"
+)
+
+const testPieceLength = 16384
+
+func testMetainfo() metainfo {
+	return metainfo{
+		pieceHashes: make([][20]byte, 4),
+		pieceLength: testPieceLength,
+		totalSize:   4*testPieceLength - 100,
+	}
+}
+
+func newTestClient(t *testing.T, ts *httptest.Server, id byte, port string, pieces *bitfield.Bitfield) client {
+	tc, err := newTrackerClient(trackerClientConfig{maxBodySize: defaultTrackerMaxBodySize, httpClient: ts.Client()})
+	if err != nil {
+		t.Fatalf("creating tracker client: %s", err)
+	}
+	c := client{port: port, tracker: tc, pieces: pieces, transferred: &transferStats{}}
+	c.peerID[0] = id
+	c.infoHash[0] = 0xaa
+	return c
+}
+
+func TestAnnounceAndScrape(t *testing.T) {
+	ts := httptest.NewServer(tracker.New(tracker.Config{}))
+	defer ts.Close()
+	host := ts.URL + "/announce"
+	m := testMetainfo()
+
+	seeder := newTestClient(t, ts, 1, "6881", bitfield.NewFull(4))
+	leecher := newTestClient(t, ts, 2, "6882", bitfield.New(4))
+
+	if _, err := seeder.tracker.announce(seeder, m, host, ""); err != nil {
+		t.Fatalf("announcing seeder: %s", err)
+	}
+	b, err := leecher.tracker.announce(leecher, m, host, "")
+	if err != nil {
+		t.Fatalf("announcing leecher: %s", err)
+	}
+	d, err := bencode.UnmarshalDict(b)
+	if err != nil {
+		t.Fatalf("unmarshaling announce response: %s", err)
+	}
+	peers, err := parseTrackerResponse(d)
+	if err != nil {
+		t.Fatalf("parsing announce response: %s", err)
+	}
+	if len(peers) != 1 || peers[0] != "127.0.0.1:6881" {
+		t.Errorf("got peers %v, expected [127.0.0.1:6881]", peers)
+	}
+
+	r, err := leecher.tracker.scrape(leecher.infoHash, host)
+	if err != nil {
+		t.Fatalf("scraping: %s", err)
+	}
+	if r.seeders != 1 || r.leechers != 1 {
+		t.Errorf("got %s, expected 1 seeder and 1 leecher", r)
+	}
+}
+
+func TestAnnounceReportsTransfer(t *testing.T) {
+	var q url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q = r.URL.Query()
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer ts.Close()
+
+	pieces := bitfield.New(4)
+	pieces.Set(0)
+	c := newTestClient(t, ts, 1, "6881", pieces)
+	c.transferred.uploaded.Add(1000)
+	c.transferred.downloaded.Add(testPieceLength)
+
+	if _, err := c.tracker.announce(c, testMetainfo(), ts.URL+"/announce", "completed"); err != nil {
+		t.Fatalf("announcing: %s", err)
+	}
+	expected := map[string]string{
+		"uploaded":   "1000",
+		"downloaded": "16384",
+		"left":       "49052",
+		"event":      "completed",
+		"port":       "6881",
+		"compact":    "1",
+	}
+	for k, v := range expected {
+		if q.Get(k) != v {
+			t.Errorf("got %s=%q, expected %q", k, q.Get(k), v)
+		}
+	}
+
+	if _, err := c.tracker.announce(c, testMetainfo(), ts.URL+"/announce", ""); err != nil {
+		t.Fatalf("announcing: %s", err)
+	}
+	if _, has := q["event"]; has {
+		t.Errorf("got event=%q, expected no event", q.Get("event"))
+	}
+}
+
+func TestManagePeersStop(t *testing.T) {
+	events := make(chan string, 8)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event")
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer ts.Close()
+	expect := func(event string) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e != event {
+				t.Fatalf("got event=%q, expected %q", e, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no announce with event=%q", event)
+		}
+	}
+
+	// Stopping right as the download completes still announces completion
+	for _, together := range []bool{false, true} {
+		c := newTestClient(t, ts, 1, "6881", bitfield.New(4))
+		done, stop, stopped := make(chan struct{}), make(chan struct{}), make(chan struct{})
+		go func() {
+			managePeers(c, testMetainfo(), []string{ts.URL + "/announce"}, make(chan string, 8), done, stop, false)
+			close(stopped)
+		}()
+		expect("")
+		close(done)
+		if !together {
+			expect("completed")
+		}
+		close(stop)
+		if together {
+			expect("completed")
+		}
+		expect("stopped")
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("managePeers did not return after stop was closed")
+		}
+	}
+}
+
+func TestTrackerClientGet(t *testing.T) {
+	const maxBodySize = 100
+	gzipped := func(b []byte) []byte {
+		var buf bytes.Buffer
+		z := gzip.NewWriter(&buf)
+		z.Write(b)
+		z.Close()
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name   string
+		status int
+		gzip   bool
+		body   []byte
+		err    string
+	}{
+		{"plain", http.StatusOK, false, []byte("d5:peers0:e"), ""},
+		{"gzip", http.StatusOK, true, []byte("d5:peers0:e"), ""},
+		{"status", http.StatusServiceUnavailable, false, []byte("d5:peers0:e"), "503"},
+		{"max size", http.StatusOK, false, bytes.Repeat([]byte("x"), maxBodySize), ""},
+		{"too long", http.StatusOK, false, bytes.Repeat([]byte("x"), maxBodySize+1), "longer than maximum"},
+		// The limit applies to the decompressed body
+		{"gzip too long", http.StatusOK, true, bytes.Repeat([]byte("x"), 10*maxBodySize), "longer than maximum"},
+		{"bad gzip", http.StatusOK, true, nil, "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("User-Agent") != "test/1" {
+					t.Errorf("got user agent %q, expected %q", r.Header.Get("User-Agent"), "test/1")
+				}
+				body := tt.body
+				if tt.gzip {
+					if r.Header.Get("Accept-Encoding") != "gzip" {
+						t.Errorf("gzip not accepted")
+					}
+					w.Header().Set("Content-Encoding", "gzip")
+					if body != nil {
+						body = gzipped(body)
+					}
+				}
+				w.WriteHeader(tt.status)
+				w.Write(body)
+			}))
+			defer ts.Close()
+			tc, err := newTrackerClient(trackerClientConfig{userAgent: "test/1", maxBodySize: maxBodySize, httpClient: ts.Client()})
+			if err != nil {
+				t.Fatalf("creating tracker client: %s", err)
+			}
+			u, _ := url.Parse(ts.URL + "/announce")
+
+			b, err := tc.get(u)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, expected it to mention %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getting: %s", err)
+			}
+			if !bytes.Equal(b, tt.body) {
+				t.Errorf("got body %q, expected %q", b, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const dialTimeout = 5 * time.Second
+
+// transportPolicy decides whether peer connections use TCP, uTP or both.
+// With both, we listen on either and dial the preferred one first
+type transportPolicy int
+
+const (
+	tcpOnly transportPolicy = iota
+	utpOnly
+	preferTCP
+	preferUTP
+)
+
+var transportPolicyToString = map[transportPolicy]string{
+	tcpOnly:   "tcp",
+	utpOnly:   "utp",
+	preferTCP: "prefer-tcp",
+	preferUTP: "prefer-utp",
+}
+
+func (t transportPolicy) String() string {
+	if s, has := transportPolicyToString[t]; has {
+		return s
+	}
+	return fmt.Sprintf("unknown (%d)", int(t))
+}
+
+func parseTransportPolicy(s string) (transportPolicy, error) {
+	for t, name := range transportPolicyToString {
+		if name == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown transport %q", s)
+}
+
+// networks returns the transports to try, in order
+func (t transportPolicy) networks() []string {
+	switch t {
+	case tcpOnly:
+		return []string{"tcp"}
+	case utpOnly:
+		return []string{"utp"}
+	case preferUTP:
+		return []string{"utp", "tcp"}
+	}
+	return []string{"tcp", "utp"}
+}
+
+// dial connects to addr over the transports that the policy allows
+func (s *swarm) dial(addr string) (net.Conn, error) {
+	errs := make([]string, 0)
+	for _, network := range s.transport.networks() {
+		var conn net.Conn
+		var err error
+		if network == "utp" {
+			conn, err = s.utp.DialTimeout(addr, dialTimeout)
+		} else {
+			conn, err = net.DialTimeout("tcp", addr, dialTimeout)
+		}
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", network, err))
+	}
+	return nil, fmt.Errorf("%s", strings.Join(errs, ", "))
+}
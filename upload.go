@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/pieterkockx/bittorrent/pwp"
+)
+
+// Largest block we serve; requests for more are rejected
+const maxRequestLength = uint32(0x20000)
+
+// uploadState is the part of the connection state that concerns uploading
+// to the peer
+type uploadState struct {
+	sync.Mutex
+	amChoking      bool
+	peerInterested bool
+	uploaded       int64
+}
+
+// ReadBlock reads the block at begin in piece index into p, which makes
+// metainfo the source of the blocks we upload
+func (m metainfo) ReadBlock(index, begin uint32, p []byte) error {
+	f := m.firstFile
+	totoffs := int64(m.pieceLength)*int64(index) + int64(begin)
+	start := int64(0)
+	end := f.size
+	for len(p) > 0 {
+		for totoffs >= end {
+			// f.next is not lastFile
+			f = f.next
+			start = end
+			end += f.size
+		}
+		max := int64(len(p))
+		if max > end-totoffs {
+			max = end - totoffs
+		}
+		_, err := f.file.ReadAt(p[:max], totoffs-start)
+		if err != nil {
+			return err
+		}
+		totoffs += max
+		p = p[max:]
+	}
+	return nil
+}
+
+func validateRequest(c client, m metainfo, msg pwp.Message) error {
+	if int64(msg.PieceIndex) >= int64(len(m.pieceHashes)) {
+		return fmt.Errorf("piece %d out of range", msg.PieceIndex)
+	}
+	if !c.pieces.Has(int(msg.PieceIndex)) {
+		return fmt.Errorf("piece %d not available", msg.PieceIndex)
+	}
+	if msg.BlockLength == 0 || msg.BlockLength > maxRequestLength {
+		return fmt.Errorf("block length %d bytes out of range", msg.BlockLength)
+	}
+	if int64(msg.BlockOffset)+int64(msg.BlockLength) > int64(m.pieceSize(msg.PieceIndex)) {
+		return fmt.Errorf("block (offset %d, length %d) exceeds piece %d", msg.BlockOffset, msg.BlockLength, msg.PieceIndex)
+	}
+	return nil
+}
+
+// upload answers the requests of p in order of arrival, dropping requests
+// that are cancelled before they are served. Changes in interest are passed
+// on to the choker, which decides whom to unchoke
+func upload(c client, m metainfo, p *peerConn, ch *choker) {
+	defer close(p.uploadDone)
+	queue := make([]pwp.Message, 0)
+	for {
+		var msg pwp.Message
+		if len(queue) == 0 {
+			select {
+			case msg = <-p.requests:
+			case <-p.closed:
+				return
+			}
+		} else {
+			select {
+			case msg = <-p.requests:
+			case <-p.closed:
+				return
+			default:
+				req := queue[0]
+				queue = queue[1:]
+				if !serveRequest(c, m, p, req) {
+					return
+				}
+				continue
+			}
+		}
+
+		switch msg.Typ {
+		case pwp.MessageInterested:
+			p.up.Lock()
+			p.up.peerInterested = true
+			p.up.Unlock()
+			ch.notify()
+		case pwp.MessageNotInterested:
+			p.up.Lock()
+			p.up.peerInterested = false
+			p.up.Unlock()
+			for _, r := range queue {
+				if !reject(p, r) {
+					return
+				}
+			}
+			queue = queue[:0]
+			ch.notify()
+		case pwp.MessageRequest:
+			p.up.Lock()
+			choking := p.up.amChoking
+			p.up.Unlock()
+			if choking {
+				log.Printf("upload: %s requested piece %d while choked: rejecting\n", p.info.addr, msg.PieceIndex)
+				if !reject(p, msg) {
+					return
+				}
+				continue
+			}
+			if err := validateRequest(c, m, msg); err != nil {
+				log.Printf("upload: invalid request from %s: %s: closing\n", p.info.addr, err)
+				p.close()
+				return
+			}
+			// We told the peer in the extended handshake how many
+			// requests it may have outstanding
+			if len(queue) >= maxRequestQueue {
+				if !p.info.fast {
+					log.Printf("upload: %s has more than %d outstanding requests: closing\n", p.info.addr, maxRequestQueue)
+					p.close()
+					return
+				}
+				if !reject(p, msg) {
+					return
+				}
+				continue
+			}
+			queue = append(queue, msg)
+		case pwp.MessageCancel:
+			for i := 0; i < len(queue); i++ {
+				r := queue[i]
+				if r.PieceIndex == msg.PieceIndex && r.BlockOffset == msg.BlockOffset && r.BlockLength == msg.BlockLength {
+					queue = append(queue[:i], queue[i+1:]...)
+					// With the fast extension every request is
+					// answered, also cancelled ones
+					if !reject(p, r) {
+						return
+					}
+					break
+				}
+			}
+		}
+	}
+}
+
+// reject tells p that req will not be served, if p supports the fast
+// extension; otherwise the request is dropped silently
+func reject(p *peerConn, req pwp.Message) bool {
+	if !p.info.fast {
+		return true
+	}
+	return p.send(pwp.Message{Typ: pwp.MessageRejectRequest, PieceIndex: req.PieceIndex, BlockOffset: req.BlockOffset, BlockLength: req.BlockLength})
+}
+
+func serveRequest(c client, m metainfo, p *peerConn, req pwp.Message) bool {
+	// The peer may have been choked since it sent the request
+	p.up.Lock()
+	choking := p.up.amChoking
+	p.up.Unlock()
+	if choking {
+		return reject(p, req)
+	}
+	// The block is read from storage by send, straight into its buffer
+	if !p.send(pwp.Message{Typ: pwp.MessagePiece, PieceIndex: req.PieceIndex, BlockOffset: req.BlockOffset, BlockLength: req.BlockLength}) {
+		return false
+	}
+	p.up.Lock()
+	p.up.uploaded += int64(req.BlockLength)
+	p.up.Unlock()
+	c.transferred.uploaded.Add(int64(req.BlockLength))
+	return true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pieterkockx/bittorrent/bitfield"
+	"github.com/pieterkockx/bittorrent/pwp"
+)
+
+func TestUploadRequestLimit(t *testing.T) {
+	for _, fast := range []bool{true, false} {
+		a, b := net.Pipe()
+		p := newTestPeer(0)
+		p.info.fast = fast
+		p.conn = pwp.NewConn(a, pwp.Limits{}, nil)
+		p.out = make(chan pwp.Message, 2*maxRequestQueue)
+		p.uploadDone = make(chan struct{})
+		p.up.amChoking = false
+		// All requests are in before upload starts serving
+		const n = maxRequestQueue + 10
+		p.requests = make(chan pwp.Message, n)
+		for i := 0; i < n; i++ {
+			p.requests <- pwp.Message{Typ: pwp.MessageRequest, PieceIndex: uint32(i % 4), BlockLength: 1}
+		}
+		c := client{pieces: bitfield.NewFull(4), transferred: &transferStats{}}
+		go upload(c, testMetainfo(), p, newChoker(1, 0))
+
+		if !fast {
+			// Without the fast extension there is no way to refuse
+			select {
+			case <-p.uploadDone:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("peer without fast extension not closed after too many requests")
+			}
+			if len(p.out) != 0 {
+				t.Errorf("served %d blocks before closing, expected none", len(p.out))
+			}
+			b.Close()
+			continue
+		}
+		for i := 0; i < n; i++ {
+			var msg pwp.Message
+			select {
+			case msg = <-p.out:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got %d answers, expected %d", i, n)
+			}
+			expected := pwp.MessagePiece
+			if i < n-maxRequestQueue {
+				expected = pwp.MessageRejectRequest
+			}
+			if msg.Typ != expected {
+				t.Fatalf("answer %d is %s, expected %s", i, msg.Typ, expected)
+			}
+		}
+		close(p.closed)
+		b.Close()
+	}
+}
@@ -0,0 +1,647 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// recvBufferSize is the number of bytes received but not yet read
+	// (including packets out of order) that the peer may send
+	recvBufferSize = 1 << 20
+	// sendBufferSize is the number of bytes written but not yet
+	// acknowledged, beyond which writes block
+	sendBufferSize = 1 << 20
+	// Packets further ahead than this are dropped
+	maxReorder = recvBufferSize / maxPayload
+
+	initialRTO = time.Second
+	minRTO     = 500 * time.Millisecond
+	maxRTO     = 30 * time.Second
+	// A connection fails after this many timeouts in a row
+	maxTimeouts = 8
+	// After Close, the FIN has this long to be acknowledged
+	lingerTimeout = 10 * time.Second
+
+	tickInterval = 50 * time.Millisecond
+)
+
+// Congestion control after LEDBAT: the window grows by at most
+// maxCwndIncrease bytes per round trip while the delay the packets queue up
+// on the path is under targetDelay, and shrinks when it is over
+const (
+	targetDelay     = 100 * time.Millisecond
+	maxCwndIncrease = 3000
+	minWindow       = maxPacketSize
+	maxWindow       = recvBufferSize
+)
+
+type outPacket struct {
+	typ           packetType
+	seq           uint16
+	payload       []byte
+	sent          time.Time
+	transmissions int
+}
+
+func (p *outPacket) size() int {
+	return headerLength + len(p.payload)
+}
+
+// delayHistory keeps the minimum delay per minute over the last two minutes,
+// which is taken as the delay of the path without queueing
+type delayHistory struct {
+	mins    [2]uint32
+	started time.Time
+}
+
+func (d *delayHistory) add(sample uint32, now time.Time) {
+	if d.started.IsZero() || now.Sub(d.started) >= time.Minute {
+		if d.started.IsZero() {
+			d.mins[1] = sample
+		} else {
+			d.mins[1] = d.mins[0]
+		}
+		d.mins[0] = sample
+		d.started = now
+		return
+	}
+	if sample < d.mins[0] {
+		d.mins[0] = sample
+	}
+}
+
+func (d *delayHistory) base() uint32 {
+	if d.mins[1] < d.mins[0] {
+		return d.mins[1]
+	}
+	return d.mins[0]
+}
+
+// Conn is a uTP connection. Reads and writes may happen concurrently, but
+// not two reads or two writes
+type Conn struct {
+	s      *Socket
+	raddr  net.Addr
+	recvID uint16
+	sendID uint16
+
+	// connected is closed when the SYN is acknowledged, done when the
+	// connection is torn down (err says why) and closing when Close is
+	// called
+	connected chan struct{}
+	done      chan struct{}
+	closing   chan struct{}
+	// readable and writable signal waiting reads and writes that
+	// something changed
+	readable chan struct{}
+	writable chan struct{}
+
+	mu          sync.Mutex
+	isConnected bool
+	isClosing   bool
+	isDone      bool
+	err         error
+
+	// Sending: sbuf holds what was written but not sent yet, seq is the
+	// sequence number of the next packet, unacked the packets in flight in
+	// order. While recovering, packets up to recoverSeq may have been lost
+	sbuf       bytes.Buffer
+	seq        uint16
+	unacked    []*outPacket
+	inflight   int
+	finSent    bool
+	recovering bool
+	recoverSeq uint16
+	cwnd       float64
+	peerWnd    int
+	dupAcks    int
+	rtt        time.Duration
+	rttVar     time.Duration
+	rto        time.Duration
+	timeouts   int
+	delays     delayHistory
+
+	// Receiving: ack is the last sequence number received in order
+	ack        uint16
+	rbuf       bytes.Buffer
+	reorder    map[uint16][]byte
+	reordered  int
+	finSeq     uint16
+	finRecv    bool
+	eof        bool
+	replyMicro uint32
+	// The window we last advertised was too small for a packet
+	windowShut bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(s *Socket, raddr net.Addr, recvID, sendID uint16) *Conn {
+	return &Conn{
+		s:         s,
+		raddr:     raddr,
+		recvID:    recvID,
+		sendID:    sendID,
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+		closing:   make(chan struct{}),
+		readable:  make(chan struct{}, 1),
+		writable:  make(chan struct{}, 1),
+		cwnd:      2 * maxPacketSize,
+		peerWnd:   maxPacketSize,
+		rto:       initialRTO,
+		reorder:   map[uint16][]byte{},
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// accept answers the SYN that created an inbound connection
+func (c *Conn) accept(syn header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var b [2]byte
+	rand.Read(b[:])
+	c.seq = binary.BigEndian.Uint16(b[:])
+	c.ack = syn.seq
+	c.peerWnd = int(syn.wnd)
+	c.replyMicro = microseconds(time.Now()) - syn.timestamp
+	c.isConnected = true
+	close(c.connected)
+	c.sendState()
+}
+
+// recvWindow must be called with c.mu held
+func (c *Conn) recvWindow() int {
+	n := recvBufferSize - c.rbuf.Len() - c.reordered
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// writePacket must be called with c.mu held
+func (c *Conn) writePacket(typ packetType, seq uint16, payload []byte) {
+	b := make([]byte, headerLength+len(payload))
+	wnd := c.recvWindow()
+	c.windowShut = wnd < maxPacketSize
+	header{
+		typ:           typ,
+		connID:        c.sendID,
+		timestamp:     microseconds(time.Now()),
+		timestampDiff: c.replyMicro,
+		wnd:           uint32(wnd),
+		seq:           seq,
+		ack:           c.ack,
+	}.marshal(b)
+	if typ == stSyn {
+		// The SYN carries the ID of the packets we receive
+		binary.BigEndian.PutUint16(b[2:4], c.recvID)
+	}
+	copy(b[headerLength:], payload)
+	c.s.write(b, c.raddr)
+}
+
+// sendState acknowledges what was received, without taking a sequence
+// number. It must be called with c.mu held
+func (c *Conn) sendState() {
+	c.writePacket(stState, c.seq, nil)
+}
+
+// sendPacket sends a packet that takes a sequence number and must be
+// acknowledged. It must be called with c.mu held
+func (c *Conn) sendPacket(typ packetType, payload []byte) {
+	p := &outPacket{typ: typ, seq: c.seq, payload: payload, sent: time.Now(), transmissions: 1}
+	c.seq++
+	c.unacked = append(c.unacked, p)
+	c.inflight += p.size()
+	c.writePacket(p.typ, p.seq, p.payload)
+}
+
+// resend must be called with c.mu held
+func (c *Conn) resend(p *outPacket) {
+	p.sent = time.Now()
+	p.transmissions++
+	c.writePacket(p.typ, p.seq, p.payload)
+}
+
+// flush sends what was written as far as the windows allow, and the FIN
+// after it once Close was called. It must be called with c.mu held
+func (c *Conn) flush() {
+	window := int(c.cwnd)
+	if c.peerWnd < window {
+		window = c.peerWnd
+	}
+	for c.sbuf.Len() > 0 {
+		n := c.sbuf.Len()
+		if n > maxPayload {
+			n = maxPayload
+		}
+		// With nothing in flight a packet is sent anyway, which probes
+		// a window that is shut
+		if c.inflight > 0 && c.inflight+headerLength+n > window {
+			return
+		}
+		b := make([]byte, n)
+		c.sbuf.Read(b)
+		c.sendPacket(stData, b)
+	}
+	if c.isClosing && !c.finSent {
+		c.finSent = true
+		c.sendPacket(stFin, nil)
+	}
+}
+
+// enterRecovery resends the first packet in flight, which was lost. Until
+// everything that is in flight now is acknowledged, every partial
+// acknowledgement resends the next packet. It must be called with c.mu held
+func (c *Conn) enterRecovery() {
+	c.recovering = true
+	c.recoverSeq = c.seq - 1
+	c.resend(c.unacked[0])
+}
+
+// fail tears the connection down with err, unless it already is
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.teardown(err)
+}
+
+// teardown must be called with c.mu held
+func (c *Conn) teardown(err error) {
+	if c.isDone {
+		return
+	}
+	c.isDone = true
+	c.err = err
+	close(c.done)
+	c.s.remove(c)
+}
+
+// receive handles a packet of the connection
+func (c *Conn) receive(h header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isDone {
+		return
+	}
+	now := time.Now()
+	c.replyMicro = microseconds(now) - h.timestamp
+
+	switch h.typ {
+	case stReset:
+		c.teardown(fmt.Errorf("connection reset by peer"))
+		return
+	case stSyn:
+		// Our answer to the SYN was lost
+		c.sendState()
+		return
+	}
+	if !c.isConnected {
+		if h.typ != stState {
+			return
+		}
+		c.ack = h.seq - 1
+		c.isConnected = true
+		close(c.connected)
+	}
+	c.peerWnd = int(h.wnd)
+
+	c.handleAck(h, now)
+	if c.isDone {
+		return
+	}
+	if h.typ == stData || h.typ == stFin {
+		c.handleData(h, payload)
+	}
+}
+
+// handleAck must be called with c.mu held
+func (c *Conn) handleAck(h header, now time.Time) {
+	acked := 0
+	var last *outPacket
+	resent := false
+	for len(c.unacked) > 0 && !seqLess(h.ack, c.unacked[0].seq) {
+		p := c.unacked[0]
+		c.unacked = c.unacked[1:]
+		c.inflight -= p.size()
+		acked += p.size()
+		last = p
+		if p.transmissions > 1 {
+			resent = true
+		}
+	}
+	// Only packets sent once give an unambiguous round trip time, and the
+	// ones acknowledged along with a resent packet were waiting for it
+	if last != nil && !resent {
+		c.updateRTT(now.Sub(last.sent))
+	}
+	if acked == 0 {
+		if h.typ == stState && len(c.unacked) > 0 && h.ack == c.unacked[0].seq-1 {
+			c.dupAcks++
+			if c.dupAcks == 3 && !c.recovering {
+				// The first packet in flight was lost
+				c.cwnd /= 2
+				if c.cwnd < minWindow {
+					c.cwnd = minWindow
+				}
+				c.enterRecovery()
+			}
+		}
+		c.flush()
+		return
+	}
+	c.dupAcks = 0
+	c.timeouts = 0
+	if c.recovering {
+		if len(c.unacked) > 0 && seqLess(h.ack, c.recoverSeq) {
+			// Only part of what was in flight arrived, so the next
+			// packet was lost as well
+			c.resend(c.unacked[0])
+		} else {
+			c.recovering = false
+		}
+	}
+	if h.timestampDiff != 0 {
+		c.delays.add(h.timestampDiff, now)
+		c.updateWindow(h.timestampDiff, acked)
+	}
+	c.flush()
+	signal(c.writable)
+	c.finish()
+}
+
+// finish tears the connection down once our FIN is acknowledged and the FIN
+// of the peer has arrived, so that neither side is left resending its FIN
+// until the linger timeout. It must be called with c.mu held
+func (c *Conn) finish() {
+	if c.finSent && len(c.unacked) == 0 && c.eof {
+		c.teardown(net.ErrClosed)
+	}
+}
+
+// updateRTT must be called with c.mu held
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+}
+
+// updateWindow applies LEDBAT to the congestion window after acked bytes
+// were acknowledged with a delay of sample microseconds. It must be called
+// with c.mu held
+func (c *Conn) updateWindow(sample uint32, acked int) {
+	queued := time.Duration(sample-c.delays.base()) * time.Microsecond
+	offTarget := float64(targetDelay-queued) / float64(targetDelay)
+	c.cwnd += maxCwndIncrease * offTarget * float64(acked) / c.cwnd
+	if c.cwnd < minWindow {
+		c.cwnd = minWindow
+	}
+	if c.cwnd > maxWindow {
+		c.cwnd = maxWindow
+	}
+}
+
+// handleData must be called with c.mu held
+func (c *Conn) handleData(h header, payload []byte) {
+	if !seqLess(c.ack, h.seq) {
+		// Our acknowledgement was lost
+		c.sendState()
+		return
+	}
+	if h.typ == stFin && !c.finRecv {
+		c.finRecv = true
+		c.finSeq = h.seq
+	}
+	if h.seq != c.ack+1 {
+		if _, has := c.reorder[h.seq]; !has && h.seq-c.ack <= maxReorder && len(payload) <= c.recvWindow() {
+			b := make([]byte, len(payload))
+			copy(b, payload)
+			c.reorder[h.seq] = b
+			c.reordered += len(b)
+		}
+		c.sendState()
+		return
+	}
+	if len(payload) > c.recvWindow()+maxPacketSize {
+		// Not read fast enough; the peer will send it again
+		return
+	}
+	c.rbuf.Write(payload)
+	c.ack = h.seq
+	for {
+		b, has := c.reorder[c.ack+1]
+		if !has {
+			break
+		}
+		delete(c.reorder, c.ack+1)
+		c.reordered -= len(b)
+		c.rbuf.Write(b)
+		c.ack++
+	}
+	if c.finRecv && c.ack == c.finSeq {
+		c.eof = true
+	}
+	c.sendState()
+	signal(c.readable)
+	c.finish()
+}
+
+// tick retransmits packets that timed out until the connection is torn
+// down
+func (c *Conn) tick() {
+	t := time.NewTicker(tickInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-t.C:
+			c.mu.Lock()
+			if len(c.unacked) > 0 && now.Sub(c.unacked[0].sent) > c.rto {
+				c.timeouts++
+				if c.timeouts > maxTimeouts {
+					c.teardown(fmt.Errorf("connection timed out"))
+					c.mu.Unlock()
+					return
+				}
+				c.cwnd = minWindow
+				c.rto *= 2
+				if c.rto > maxRTO {
+					c.rto = maxRTO
+				}
+				c.enterRecovery()
+			}
+			c.flush()
+			c.mu.Unlock()
+		}
+	}
+}
+
+// wait waits until ch is signalled, the deadline passes or the connection is
+// closed or torn down. It must be called without c.mu held
+func (c *Conn) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ch:
+	case <-c.done:
+	case <-c.closing:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		switch {
+		case c.isClosing:
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		case c.rbuf.Len() > 0:
+			n, _ := c.rbuf.Read(p)
+			if c.windowShut && c.recvWindow() >= maxPacketSize && !c.isDone {
+				// Tell the peer it may send again
+				c.sendState()
+			}
+			c.mu.Unlock()
+			return n, nil
+		case c.eof:
+			c.mu.Unlock()
+			return 0, io.EOF
+		case c.isDone:
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		if err := c.wait(c.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write returns once p is in the send buffer, not when it is acknowledged
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		c.mu.Lock()
+		switch {
+		case c.isClosing:
+			c.mu.Unlock()
+			return written, net.ErrClosed
+		case c.isDone:
+			err := c.err
+			c.mu.Unlock()
+			return written, err
+		}
+		room := sendBufferSize - c.sbuf.Len() - c.inflight
+		if room > 0 {
+			if room > len(p)-written {
+				room = len(p) - written
+			}
+			c.sbuf.Write(p[written : written+room])
+			written += room
+			c.flush()
+			c.mu.Unlock()
+			continue
+		}
+		deadline := c.writeDeadline
+		c.mu.Unlock()
+		if err := c.wait(c.writable, deadline); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close sends a FIN after the data that was written. The connection stays
+// around until everything is acknowledged and the peer closed as well, or the
+// linger timeout passes
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosing {
+		return nil
+	}
+	c.isClosing = true
+	close(c.closing)
+	if c.isDone {
+		return nil
+	}
+	if !c.isConnected {
+		c.teardown(net.ErrClosed)
+		return nil
+	}
+	c.flush()
+	time.AfterFunc(lingerTimeout, func() { c.fail(net.ErrClosed) })
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	// A read that is waiting picks up the new deadline
+	signal(c.readable)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	signal(c.writable)
+	return nil
+}
@@ -0,0 +1,110 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+type packetType uint8
+
+const (
+	stData packetType = iota
+	stFin
+	stState
+	stReset
+	stSyn
+)
+
+var packetTypeToString = map[packetType]string{
+	stData:  "data",
+	stFin:   "fin",
+	stState: "state",
+	stReset: "reset",
+	stSyn:   "syn",
+}
+
+func (t packetType) String() string {
+	if s, has := packetTypeToString[t]; has {
+		return s
+	}
+	return fmt.Sprintf("unknown (%d)", int(t))
+}
+
+const (
+	version      = 1
+	headerLength = 20
+	// maxPacketSize keeps packets within the usual MTU, along with the IP
+	// and UDP headers
+	maxPacketSize = 1400
+	maxPayload    = maxPacketSize - headerLength
+)
+
+type header struct {
+	typ    packetType
+	connID uint16
+	// timestamp is the time of sending in microseconds, timestampDiff the
+	// difference between the time the last packet of the peer was received
+	// and its timestamp
+	timestamp     uint32
+	timestampDiff uint32
+	wnd           uint32
+	seq           uint16
+	ack           uint16
+}
+
+func (h header) marshal(b []byte) {
+	b[0] = byte(h.typ)<<4 | version
+	b[1] = 0
+	binary.BigEndian.PutUint16(b[2:4], h.connID)
+	binary.BigEndian.PutUint32(b[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:12], h.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:16], h.wnd)
+	binary.BigEndian.PutUint16(b[16:18], h.seq)
+	binary.BigEndian.PutUint16(b[18:20], h.ack)
+}
+
+// parsePacket returns the header and payload of a packet. Extensions (such
+// as selective acks) are skipped
+func parsePacket(b []byte) (header, []byte, error) {
+	if len(b) < headerLength {
+		return header{}, nil, fmt.Errorf("packet too short (%d bytes)", len(b))
+	}
+	if b[0]&0x0f != version {
+		return header{}, nil, fmt.Errorf("packet has unknown version %d", b[0]&0x0f)
+	}
+	h := header{
+		typ:           packetType(b[0] >> 4),
+		connID:        binary.BigEndian.Uint16(b[2:4]),
+		timestamp:     binary.BigEndian.Uint32(b[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(b[8:12]),
+		wnd:           binary.BigEndian.Uint32(b[12:16]),
+		seq:           binary.BigEndian.Uint16(b[16:18]),
+		ack:           binary.BigEndian.Uint16(b[18:20]),
+	}
+	if h.typ > stSyn {
+		return header{}, nil, fmt.Errorf("packet has unknown type %s", h.typ)
+	}
+	ext := b[1]
+	b = b[headerLength:]
+	for ext != 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return header{}, nil, fmt.Errorf("packet has truncated extension")
+		}
+		ext = b[0]
+		b = b[2+int(b[1]):]
+	}
+	return h, b, nil
+}
+
+// seqLess reports whether a comes before b, allowing for wrap around
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+var epoch = time.Now()
+
+// microseconds returns a timestamp for the header of a packet
+func microseconds(t time.Time) uint32 {
+	return uint32(t.Sub(epoch) / time.Microsecond)
+}
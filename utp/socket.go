@@ -0,0 +1,223 @@
+// Package utp implements the Micro Transport Protocol (BEP 29), reliable
+// streams over UDP whose congestion control (LEDBAT) backs off when the
+// delay on the path grows, so that it yields to other traffic
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Connections that are not accepted yet, beyond which new ones are
+	// dropped
+	acceptBacklog    = 16
+	socketBufferSize = 4 << 20
+)
+
+type connKey struct {
+	addr string
+	// id is the connection ID of the packets we receive
+	id uint16
+}
+
+// Socket multiplexes uTP connections over one UDP socket. It is a
+// net.Listener for inbound connections and dials outbound ones from the same
+// port
+type Socket struct {
+	pc net.PacketConn
+
+	mu    sync.Mutex
+	conns map[connKey]*Conn
+
+	accepted  chan *Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func Listen(addr string) (*Socket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if u, ok := pc.(*net.UDPConn); ok {
+		// The windows of all connections may arrive at once
+		u.SetReadBuffer(socketBufferSize)
+		u.SetWriteBuffer(socketBufferSize)
+	}
+	return newSocket(pc), nil
+}
+
+// newSocket runs uTP over pc, which need not be a UDP socket
+func newSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:       pc,
+		conns:    map[connKey]*Conn{},
+		accepted: make(chan *Conn, acceptBacklog),
+		closed:   make(chan struct{}),
+	}
+	go s.read()
+	return s
+}
+
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accepted:
+		return c, nil
+	case <-s.closed:
+		return nil, fmt.Errorf("accepting uTP connection: %w", net.ErrClosed)
+	}
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close closes the socket, which breaks all connections on it
+func (s *Socket) Close() error {
+	err := s.pc.Close()
+	s.closeOnce.Do(func() { close(s.closed) })
+	return err
+}
+
+// DialTimeout connects to addr, giving up after timeout
+func (s *Socket) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var c *Conn
+	s.mu.Lock()
+	for c == nil {
+		var b [2]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		id := binary.BigEndian.Uint16(b[:])
+		key := connKey{raddr.String(), id}
+		if _, has := s.conns[key]; !has {
+			c = newConn(s, raddr, id, id+1)
+			s.conns[key] = c
+		}
+	}
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.seq = 1
+	c.sendPacket(stSyn, nil)
+	c.mu.Unlock()
+	go c.tick()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.done:
+		return nil, fmt.Errorf("dialing %s: %s", addr, c.err)
+	case <-t.C:
+		c.fail(fmt.Errorf("connection timed out"))
+		return nil, fmt.Errorf("dialing %s: timed out", addr)
+	}
+}
+
+// remove is called with c.mu held, so s.mu must never be held while taking
+// the lock of a connection
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{c.raddr.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) write(b []byte, addr net.Addr) {
+	// Lost packets are retransmitted, so errors are not fatal
+	s.pc.WriteTo(b, addr)
+}
+
+// read hands the packets on the socket to their connections until the
+// socket is closed
+func (s *Socket) read() {
+	buf := make([]byte, 1<<16)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			s.Close()
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+			for _, c := range conns {
+				c.fail(fmt.Errorf("socket closed: %s", err))
+			}
+			return
+		}
+		h, payload, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		s.mu.Lock()
+		c, has := s.conns[connKey{addr.String(), h.connID}]
+		if !has && h.typ == stSyn {
+			// A retransmitted SYN finds the connection it created
+			key := connKey{addr.String(), h.connID + 1}
+			c, has = s.conns[key]
+			if !has && len(s.accepted) < cap(s.accepted) {
+				c = newConn(s, addr, h.connID+1, h.connID)
+				s.conns[key] = c
+				s.mu.Unlock()
+				// Only this goroutine fills the backlog, so there is
+				// still room
+				c.accept(h)
+				s.accepted <- c
+				go c.tick()
+				continue
+			}
+		}
+		if !has && h.typ == stReset {
+			// A reset carries the ID that the connection sends with
+			for _, id := range []uint16{h.connID - 1, h.connID + 1} {
+				if r, ok := s.conns[connKey{addr.String(), id}]; ok && r.sendID == h.connID {
+					c = r
+				}
+			}
+		}
+		s.mu.Unlock()
+		if c == nil {
+			switch h.typ {
+			case stSyn:
+				log.Printf("utp: dropping connection from %s: too many pending connections\n", addr)
+			case stReset:
+			default:
+				// The connection is gone, e.g. because our last ACK
+				// was lost, so the peer need not linger
+				s.reset(h, addr)
+			}
+			continue
+		}
+		c.receive(h, payload)
+	}
+}
+
+// reset answers packet h from addr, which is of no connection we know
+func (s *Socket) reset(h header, addr net.Addr) {
+	b := make([]byte, headerLength)
+	header{
+		typ:       stReset,
+		connID:    h.connID,
+		timestamp: microseconds(time.Now()),
+		ack:       h.seq,
+	}.marshal(b)
+	s.write(b, addr)
+}
@@ -0,0 +1,245 @@
+package utp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConn drops and delays some of the packets written to it, the delayed
+// ones arriving after packets written later
+type lossyConn struct {
+	net.PacketConn
+	dropEvery  int
+	delayEvery int
+
+	mu sync.Mutex
+	n  int
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.n++
+	n := c.n
+	c.mu.Unlock()
+	switch {
+	case c.dropEvery > 0 && n%c.dropEvery == 0:
+		return len(b), nil
+	case c.delayEvery > 0 && n%c.delayEvery == 0:
+		p := append([]byte(nil), b...)
+		time.AfterFunc(20*time.Millisecond, func() { c.PacketConn.WriteTo(p, addr) })
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func listen(t *testing.T, wrap func(net.PacketConn) net.PacketConn) *Socket {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	if wrap != nil {
+		pc = wrap(pc)
+	}
+	s := newSocket(pc)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// connect dials b from a and returns both ends of the connection
+func connect(t *testing.T, a, b *Socket) (net.Conn, net.Conn) {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := b.Accept()
+		if err != nil {
+			t.Errorf("accepting: %s", err)
+		}
+		accepted <- c
+	}()
+	ca, err := a.DialTimeout(b.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("dialing: %s", err)
+	}
+	cb := <-accepted
+	if cb == nil {
+		t.FailNow()
+	}
+	if cb.RemoteAddr().String() != a.Addr().String() {
+		t.Errorf("got remote address %s, expected %s", cb.RemoteAddr(), a.Addr())
+	}
+	return ca, cb
+}
+
+func randomData(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+// exchange writes data to c while reading as much as the other end writes
+func exchange(t *testing.T, c net.Conn, data, expected []byte, wg *sync.WaitGroup) {
+	defer wg.Done()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Write(data)
+		errc <- err
+	}()
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	b := make([]byte, len(expected))
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Errorf("reading: %s", err)
+	} else if !bytes.Equal(b, expected) {
+		t.Errorf("received data differs from sent data")
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("writing: %s", err)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	lossy := func(pc net.PacketConn) net.PacketConn {
+		return &lossyConn{PacketConn: pc, dropEvery: 10, delayEvery: 7}
+	}
+	tests := []struct {
+		name string
+		wrap func(net.PacketConn) net.PacketConn
+		size int
+	}{
+		{"loopback", nil, 4 << 20},
+		{"lossy", lossy, 1 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := listen(t, tt.wrap), listen(t, tt.wrap)
+			ca, cb := connect(t, a, b)
+			up, down := randomData(tt.size), randomData(tt.size+1)
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go exchange(t, ca, up, down, &wg)
+			go exchange(t, cb, down, up, &wg)
+			wg.Wait()
+
+			// Everything was read, so the FIN comes right after
+			ca.Close()
+			cb.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if n, err := cb.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("got %d bytes and error %v after the FIN, expected EOF", n, err)
+			}
+			cb.Close()
+			waitForgotten(t, a, b)
+		})
+	}
+}
+
+// waitForgotten waits until the sockets dropped all their connections
+func waitForgotten(t *testing.T, sockets ...*Socket) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n := 0
+		for _, s := range sockets {
+			s.mu.Lock()
+			n += len(s.conns)
+			s.mu.Unlock()
+		}
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections left after both ends closed", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClose(t *testing.T) {
+	a, b := listen(t, nil), listen(t, nil)
+	ca, cb := connect(t, a, b)
+
+	if _, err := ca.Write([]byte("hello")); err != nil {
+		t.Fatalf("writing: %s", err)
+	}
+	ca.Close()
+	if _, err := ca.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got error %v reading after Close, expected %v", err, net.ErrClosed)
+	}
+	if _, err := ca.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got error %v writing after Close, expected %v", err, net.ErrClosed)
+	}
+
+	// The data written before Close arrives before the FIN
+	cb.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(cb)
+	if err != nil || string(got) != "hello" {
+		t.Errorf("got %q and error %v, expected %q and EOF", got, err, "hello")
+	}
+
+	// Neither side lingers once both FINs are through
+	cb.Close()
+	waitForgotten(t, a, b)
+}
+
+func TestDialTimeout(t *testing.T) {
+	// Nothing answers on a plain UDP socket
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	defer pc.Close()
+
+	s := listen(t, nil)
+	start := time.Now()
+	if _, err := s.DialTimeout(pc.LocalAddr().String(), 200*time.Millisecond); err == nil {
+		t.Fatalf("dialing a silent address succeeded")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("dialing gave up after %s, expected 200ms", d)
+	}
+}
+
+func TestSocketClose(t *testing.T) {
+	a, b := listen(t, nil), listen(t, nil)
+	ca, _ := connect(t, a, b)
+
+	b.Close()
+	if _, err := b.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got error %v accepting on a closed socket, expected %v", err, net.ErrClosed)
+	}
+	a.Close()
+	ca.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ca.Read(make([]byte, 1)); err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("got error %v reading on a closed socket, expected a failure", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	// Either end may be the one that forgot the connection
+	for _, dialer := range []bool{true, false} {
+		a, b := listen(t, nil), listen(t, nil)
+		ca, cb := connect(t, a, b)
+		gone, other := cb, ca
+		if dialer {
+			gone, other = ca, cb
+		}
+		// Tearing down sends nothing, as when the last ACK was lost
+		gone.(*Conn).fail(net.ErrClosed)
+
+		if _, err := other.Write([]byte("hello")); err != nil {
+			t.Fatalf("writing: %s", err)
+		}
+		other.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := other.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("got error %v from a forgotten connection, expected a reset", err)
+		}
+		waitForgotten(t, a, b)
+	}
+}